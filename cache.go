@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/gargs/process"
+)
+
+// cacheKey returns a function for process.Options.CacheKey. The key is from the command, the
+// shell, $PROCESS_I (if the command uses it), the --cache-env variables and the contents of the --cache-inputs files of the job.
+func cacheKey(args *Params) func(i int, cmd string) string {
+	return func(i int, cmd string) string {
+		shell := args.Shell
+		if args.NoShell {
+			shell = ""
+		}
+		parts := [][]byte{[]byte(shell), []byte(cmd)}
+		// a command that uses $PROCESS_I may give different output for each index.
+		if strings.Contains(cmd, "PROCESS_I") {
+			parts = append(parts, []byte(fmt.Sprintf("PROCESS_I=%d", i)))
+		}
+		for _, e := range args.CacheEnv {
+			parts = append(parts, []byte(e+"="+os.Getenv(e)))
+		}
+		if j := args.jobs.get(i); j != nil {
+			for _, path := range j.cacheInputs {
+				h, err := hashFile(path)
+				if err != nil {
+					// run the command (which will likely fail) without caching it.
+					return ""
+				}
+				parts = append(parts, []byte(path), h)
+			}
+		}
+		return process.Key(parts...)
+	}
+}
+
+// hashFile returns the sha256 of the contents of the file at path.
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// parseSize parses a size in bytes with an optional suffix of K, M, G or T (powers of 1024).
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i != -1 {
+			mult = 1 << (10 * uint(i+1))
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// upToDate reports whether every --creates path of j exists and (with --depends) is newer
+// than all of its --depends paths. It is false if j has no --creates paths.
+func upToDate(j *job) bool {
+	if len(j.creates) == 0 {
+		return false
+	}
+	var newest time.Time
+	for _, d := range j.depends {
+		fi, err := os.Stat(d)
+		if err != nil {
+			// let the command run (and likely fail) rather than skip it.
+			return false
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	for _, c := range j.creates {
+		fi, err := os.Stat(c)
+		if err != nil || !fi.ModTime().After(newest) {
+			return false
+		}
+	}
+	return true
+}
+
+// modTimes returns the modification times of the paths that exist.
+func modTimes(paths []string) map[string]time.Time {
+	m := make(map[string]time.Time, len(paths))
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil {
+			m[p] = fi.ModTime()
+		}
+	}
+	return m
+}
+
+// removeOutputs removes the --creates paths of a command that failed. Only files that the
+// command created or modified (according to j.created) are removed so that directories and
+// outputs of earlier runs are left alone.
+func removeOutputs(j *job) {
+	if j == nil {
+		return
+	}
+	for _, c := range j.creates {
+		fi, err := os.Stat(c)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if t, ok := j.created[c]; ok && fi.ModTime().Equal(t) {
+			continue
+		}
+		os.Remove(c)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/brentp/gargs/process"
+)
+
+// haltPolicy decides when to stop running commands based on how many have failed or succeeded.
+// It is parsed from --halt, e.g. "soon,fail=5", "now,fail=10%" or "now,done=1".
+type haltPolicy struct {
+	spec string
+	// now kills running commands. Otherwise they are allowed to finish but no more are started.
+	now bool
+	// done counts commands that succeeded. Otherwise commands that failed are counted.
+	done bool
+	n    int
+	// pct, if set, is the percentage of finished commands instead of the count in n.
+	pct float64
+
+	mu                     sync.Mutex
+	finished, failed, succ int
+	halted                 bool
+	// stop is called (once) when the policy is met.
+	stop func()
+}
+
+// minPctFinished is the number of commands that must finish before a percentage is used
+// so that, e.g. fail=10% does not halt because the first command failed.
+const minPctFinished = 3
+
+func parseHalt(spec string) (*haltPolicy, error) {
+	h := &haltPolicy{spec: spec}
+	parts := strings.SplitN(spec, ",", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected WHEN,fail=N or WHEN,done=N. got: %q", spec)
+	}
+	switch parts[0] {
+	case "now":
+		h.now = true
+	case "soon":
+	default:
+		return nil, fmt.Errorf("expected 'now' or 'soon'. got: %q", parts[0])
+	}
+	kv := strings.SplitN(parts[1], "=", 2)
+	if len(kv) != 2 || (kv[0] != "fail" && kv[0] != "done") {
+		return nil, fmt.Errorf("expected fail=N or done=N. got: %q", parts[1])
+	}
+	h.done = kv[0] == "done"
+	if v := strings.TrimSuffix(kv[1], "%"); v != kv[1] {
+		pct, err := strconv.ParseFloat(v, 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, fmt.Errorf("invalid percentage: %q", kv[1])
+		}
+		h.pct = pct
+	} else {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid number of commands: %q", kv[1])
+		}
+		h.n = n
+	}
+	return h, nil
+}
+
+// add counts a finished command and calls stop if the policy is met.
+// It is used as process.Options.Finished so it may be called concurrently.
+func (h *haltPolicy) add(c *process.Command) {
+	if c.Killed || errors.Is(c.Err, context.Canceled) {
+		// killed or not started because gargs is stopping.
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.finished++
+	if c.ExitCode() == 0 {
+		h.succ++
+	} else {
+		h.failed++
+	}
+	if h.halted || !h.met() {
+		return
+	}
+	h.halted = true
+	h.stop()
+}
+
+func (h *haltPolicy) met() bool {
+	count := h.failed
+	if h.done {
+		count = h.succ
+	}
+	if h.pct > 0 {
+		return h.finished >= minPctFinished && float64(count)*100 >= h.pct*float64(h.finished)
+	}
+	return count >= h.n
+}
+
+// Halted reports whether the policy was met.
+func (h *haltPolicy) Halted() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.halted
+}
+
+// gate sends commands to the returned channel until stop is closed.
+func gate(cmds <-chan string, stop <-chan struct{}) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for c := range cmds {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			select {
+			case out <- c:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// isClosed is a non-blocking check of whether ch has been closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
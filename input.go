@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// record is a single record of input (usually a line) and its fields if it was split.
+type record struct {
+	line   string
+	fields []string
+	// values from --jsonl keyed by their path.
+	values map[string]string
+	// 1-based number of the record in the input.
+	lineno int
+}
+
+// recordReader reads records from the input. Read returns io.EOF when there are no more.
+type recordReader interface {
+	Read() (*record, error)
+}
+
+func newRecordReader(args *Params) (recordReader, error) {
+	if args.JSONL {
+		return &jsonReader{newScanReader(os.Stdin, args.RecordSep, nil)}, nil
+	}
+	if args.CSV {
+		return newCSVReader(os.Stdin, []rune(args.Sep)[0]), nil
+	}
+	var resep *regexp.Regexp
+	if args.Sep != "" {
+		var err error
+		if resep, err = regexp.Compile(args.Sep); err != nil {
+			return nil, err
+		}
+	}
+	return newScanReader(os.Stdin, args.RecordSep, resep), nil
+}
+
+// scanReader reads records separated by newlines (or a custom separator) and splits them with a regexp.
+type scanReader struct {
+	scanner *bufio.Scanner
+	resep   *regexp.Regexp
+	n       int
+}
+
+func newScanReader(r io.Reader, sep string, resep *regexp.Regexp) *scanReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 16384), 5e9)
+	if sep != "" && sep != "\n" {
+		scanner.Split(splitOn([]byte(sep)))
+	}
+	return &scanReader{scanner: scanner, resep: resep}
+}
+
+func (s *scanReader) Read() (*record, error) {
+	if !s.scanner.Scan() {
+		if err := s.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	s.n++
+	r := &record{line: s.scanner.Text(), lineno: s.n}
+	if s.resep != nil {
+		r.fields = s.resep.Split(r.line, -1)
+	}
+	return r, nil
+}
+
+// splitOn returns a bufio.SplitFunc that splits records on sep.
+// A trailing sep does not create an empty final record.
+func splitOn(sep []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.Index(data, sep); i >= 0 {
+			return i + len(sep), data[:i], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		// request more data.
+		return 0, nil, nil
+	}
+}
+
+// csvReader reads records with encoding/csv so that quoted fields (which may contain
+// the delimiter or newlines) are handled. The line of each record is the re-encoded CSV.
+type csvReader struct {
+	rdr   *csv.Reader
+	buf   bytes.Buffer
+	wtr   *csv.Writer
+	comma rune
+}
+
+func newCSVReader(r io.Reader, comma rune) *csvReader {
+	c := &csvReader{rdr: csv.NewReader(r), comma: comma}
+	c.rdr.Comma = comma
+	c.rdr.FieldsPerRecord = -1
+	c.wtr = csv.NewWriter(&c.buf)
+	c.wtr.Comma = comma
+	return c
+}
+
+func (c *csvReader) Read() (*record, error) {
+	fields, err := c.rdr.Read()
+	if err != nil {
+		return nil, err
+	}
+	c.buf.Reset()
+	c.wtr.Write(fields)
+	c.wtr.Flush()
+	line, _ := c.rdr.FieldPos(0)
+	return &record{line: strings.TrimSuffix(c.buf.String(), "\n"), fields: fields, lineno: line}, c.wtr.Error()
+}
+
+// jsonReader reads records where each line is a JSON object.
+type jsonReader struct {
+	*scanReader
+}
+
+func (j *jsonReader) Read() (*record, error) {
+	r, err := j.scanReader.Read()
+	if err != nil {
+		return r, err
+	}
+	dec := json.NewDecoder(strings.NewReader(r.line))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("input line %d: expected a JSON object: %s", r.lineno, err)
+	}
+	r.values = make(map[string]string)
+	flattenJSON("", obj, r.values)
+	return r, nil
+}
+
+// flattenJSON adds each value in v to m with a key that is its path with object keys and
+// array indexes joined by '.'. e.g. {"files": ["a"]} gives "files" => `["a"]` and "files.0" => "a".
+// Strings are added as-is, null as an empty string, and other values as JSON.
+func flattenJSON(path string, v interface{}, m map[string]string) {
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "." + k
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			flattenJSON(join(k), val, m)
+		}
+	case []interface{}:
+		for i, val := range t {
+			flattenJSON(join(strconv.Itoa(i)), val, m)
+		}
+	case string:
+		m[path] = t
+		return
+	case nil:
+		m[path] = ""
+		return
+	}
+	if path != "" {
+		b, _ := json.Marshal(v)
+		m[path] = string(b)
+	}
+}
+
+// fillTmplMap creates the values for the template place-holders from a group of up to nlines records (see -n).
+// {} is the lines joined by a space. If nlines is 1, {N} is the Nth field of the line.
+// Otherwise, {N} is the Nth line. If the lines are split (see -s), {N.M} is the
+// Mth field of the Nth line. If header is given, its values can be used in place of M
+// (or N when nlines is 1). Values from --jsonl are used in the same way.
+func fillTmplMap(recs []*record, nlines int, header []string) map[string]interface{} {
+	m := make(map[string]interface{}, 5)
+	lines := make([]string, len(recs))
+	for i, r := range recs {
+		lines[i] = r.line
+		si := strconv.Itoa(i)
+		if nlines > 1 || r.fields == nil {
+			m[si] = r.line
+		}
+		for name, v := range r.values {
+			m[si+"."+name] = v
+			if nlines == 1 {
+				m[name] = v
+			}
+		}
+		for j, t := range r.fields {
+			names := []string{strconv.Itoa(j)}
+			if j < len(header) {
+				names = append(names, header[j])
+			}
+			for _, name := range names {
+				m[si+"."+name] = t
+				if nlines == 1 {
+					m[name] = t
+				}
+			}
+		}
+	}
+	m["Line"] = strings.Join(lines, " ")
+	return m
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brentp/gargs/process"
+)
+
+// jobLogFields are the columns of the tsv --joblog. They are also the keys in the jsonl --joblog.
+var jobLogFields = []string{"PROCESS_I", "input", "start", "wall_time", "exit_code", "signal",
+	"retries", "stdout_bytes", "stderr_bytes", "spilled", "user_time", "sys_time", "max_rss_kb", "ctx_switches"}
+
+// jobRecord is a single entry in the --joblog.
+type jobRecord struct {
+	Index       int      `json:"PROCESS_I"`
+	Input       []string `json:"input"`
+	Start       string   `json:"start"`
+	WallTime    float64  `json:"wall_time"`
+	ExitCode    int      `json:"exit_code"`
+	Signal      int      `json:"signal"`
+	Retries     int      `json:"retries"`
+	StdoutBytes int64    `json:"stdout_bytes"`
+	StderrBytes int64    `json:"stderr_bytes"`
+	Spilled     bool     `json:"spilled"`
+	// resource usage. these are 0 if it is not available.
+	UserTime    float64 `json:"user_time"`
+	SysTime     float64 `json:"sys_time"`
+	MaxRSS      int64   `json:"max_rss_kb"`
+	CtxSwitches int64   `json:"ctx_switches"`
+}
+
+// tsv returns the fields of the record in the order of jobLogFields.
+func (r *jobRecord) tsv() []string {
+	return []string{
+		strconv.Itoa(r.Index),
+		escapeTSV(strings.Join(r.Input, "\n")),
+		r.Start,
+		strconv.FormatFloat(r.WallTime, 'f', 3, 64),
+		strconv.Itoa(r.ExitCode),
+		strconv.Itoa(r.Signal),
+		strconv.Itoa(r.Retries),
+		strconv.FormatInt(r.StdoutBytes, 10),
+		strconv.FormatInt(r.StderrBytes, 10),
+		strconv.FormatBool(r.Spilled),
+		strconv.FormatFloat(r.UserTime, 'f', 3, 64),
+		strconv.FormatFloat(r.SysTime, 'f', 3, 64),
+		strconv.FormatInt(r.MaxRSS, 10),
+		strconv.FormatInt(r.CtxSwitches, 10),
+	}
+}
+
+var tsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+// escapeTSV escapes characters that would otherwise break a tsv field.
+func escapeTSV(s string) string {
+	return tsvEscaper.Replace(s)
+}
+
+// jobLog writes a record for each command to the file given to --joblog.
+// Each record is written as soon as the command finishes.
+type jobLog struct {
+	f      *os.File
+	format string
+}
+
+func newJobLog(path, format string) (*jobLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &jobLog{f: f, format: format}
+	if format == "tsv" {
+		if _, err := f.WriteString(strings.Join(jobLogFields, "\t") + "\n"); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *jobLog) write(p *process.Command, j *job) error {
+	r := jobRecord{
+		Index:       p.Index,
+		Start:       p.Start.Format(time.RFC3339Nano),
+		WallTime:    p.Duration.Seconds(),
+		ExitCode:    p.ExitCode(),
+		Signal:      int(p.Signal()),
+		Retries:     p.Retries,
+		StdoutBytes: p.StdoutBytes,
+		StderrBytes: p.StderrBytes,
+		Spilled:     p.Spilled(),
+	}
+	if j != nil {
+		r.Input = j.lines
+	}
+	if u := p.Usage; u != nil {
+		r.UserTime = u.User.Seconds()
+		r.SysTime = u.System.Seconds()
+		r.MaxRSS = u.MaxRSS
+		r.CtxSwitches = u.VoluntaryCtxSw + u.InvoluntaryCtxSw
+	}
+	var line []byte
+	if l.format == "jsonl" {
+		var err error
+		if line, err = json.Marshal(r); err != nil {
+			return err
+		}
+	} else {
+		line = []byte(strings.Join(r.tsv(), "\t"))
+	}
+	_, err := l.f.Write(append(line, '\n'))
+	return err
+}
+
+func (l *jobLog) Close() error {
+	return l.f.Close()
+}
@@ -3,15 +3,19 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"regexp"
-	"runtime"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/alexflint/go-arg"
 	"github.com/brentp/gargs/process"
@@ -21,24 +25,154 @@ import (
 )
 
 // Version is the current version
-const Version = "0.3.9"
+const Version = "0.4.0"
 
 // ExitCode is the highest exit code seen in any command
 var ExitCode = 0
 
 // Params are the user-specified command-line arguments
 type Params struct {
-	Procs       int      `arg:"-p,help:number of processes to use."`
-	Sep         string   `arg:"-s,help:regex to split line to fill multiple template place-holders."`
-	Nlines      int      `arg:"-n,help:lines to consume for each command. -s and -n are mutually exclusive."`
-	Retry       int      `arg:"-r,help:times to retry a command if it fails (default is 0)."`
-	Ordered     bool     `arg:"-o,help:keep output in order of input."`
-	Verbose     bool     `arg:"-v,help:print commands to stderr as they are executed."`
-	StopOnError bool     `arg:"-e,--stop-on-error,help:stop all processes on any error."`
-	DryRun      bool     `arg:"-d,--dry-run,help:print (but do not run) the commands."`
-	Log         string   `arg:"-l,--log,help:file to log commands. Successful commands are prefixed with '#'."`
-	Command     string   `arg:"positional,required,help:command template to fill and execute."`
-	log         *os.File `arg:"-"`
+	Procs       int           `arg:"-p,help:number of processes to use."`
+	Sep         string        `arg:"-s,help:regex to split line to fill multiple template place-holders."`
+	Nlines      int           `arg:"-n,help:lines to consume for each command. when used with -s {N.M} is field M of line N."`
+	Null        bool          `arg:"-0,--null,help:input records are separated by a NUL character instead of a newline (e.g. from find -print0)."`
+	RecordSep   string        `arg:"--record-sep,help:string that separates input records instead of a newline. escapes such as \\t and \\x00 are allowed."`
+	Header      bool          `arg:"--header,help:use the fields of the first line as names for place-holders. e.g. {sample}."`
+	CSV         bool          `arg:"--csv,help:parse input as CSV (with quoted fields). --sep can set a single-character delimiter."`
+	JSONL       bool          `arg:"--jsonl,help:parse each line as a JSON object. place-holders such as {sample} or {files.0} are paths to values."`
+	Quote       bool          `arg:"--quote,help:quote the values of place-holders for the shell. use {raw:0} to insert a value as-is."`
+	Shell       string        `arg:"--shell,help:shell used to run each command with -c. default is $SHELL or bash."`
+	NoShell     bool          `arg:"--no-shell,help:run the command directly instead of with $SHELL -c. each argument gets a single value so pipes and redirects are not allowed."`
+	Retry       int           `arg:"-r,help:times to retry a command if it fails (default is 0)."`
+	RetryDelay  time.Duration `arg:"--retry-delay,help:time to wait before retrying a failed command. doubles (with jitter) for each retry."`
+	RetryMax    time.Duration `arg:"--retry-max-delay,help:longest time to wait before a retry. default is no limit."`
+	RetryOn     string        `arg:"--retry-on,help:only retry commands that exit with one of these codes (separated by commas)."`
+	NoRetryOn   string        `arg:"--no-retry-on,help:never retry commands that exit with one of these codes (separated by commas)."`
+	Ordered     bool          `arg:"-o,help:keep output in order of input."`
+	Tag         bool          `arg:"--tag,help:prefix each line of output with the input line and a tab. see --tag-template."`
+	TagTemplate string        `arg:"--tag-template,help:template for the prefix of each line of output (e.g. '{PROCESS_I}\\t' or '{0} '). implies --tag."`
+	Results     string        `arg:"--results,help:write the stdout; stderr; exit code and command of each command to files in this directory instead of printing them."`
+	ResultsKey  string        `arg:"--results-key,help:template for the name of the directory for each command within --results. default is {PROCESS_I}."`
+	Creates     []string      `arg:"--creates,separate,help:template for a file that the command creates. if all of these exist (and are newer than --depends) the command is skipped. may be repeated."`
+	Depends     []string      `arg:"--depends,separate,help:template for a file that the command reads. used with --creates. may be repeated."`
+	Cache       string        `arg:"--cache,help:directory to store the output of commands that succeed. identical commands are replayed from it instead of run."`
+	CacheSize   string        `arg:"--cache-size,help:largest size of --cache (e.g. 500M or 10G) after which the least recently used are removed. 0 for no limit."`
+	CacheEnv    []string      `arg:"--cache-env,separate,help:environment variable whose value is part of the --cache key. may be repeated."`
+	CacheInputs []string      `arg:"--cache-inputs,separate,help:template for a file whose contents are part of the --cache key. may be repeated."`
+	Progress    bool          `arg:"--progress,help:show a progress line on stderr. this is the default when stderr is a terminal."`
+	NoProgress  bool          `arg:"--no-progress,help:do not show the progress line."`
+	Total       int           `arg:"--total,help:number of commands that will be run. used to show the ETA with --progress."`
+	LineBuffer  bool          `arg:"--line-buffer,help:write each line of stdout as soon as it is complete instead of all output when each command finishes."`
+	Verbose     bool          `arg:"-v,help:print commands to stderr as they are executed."`
+	StopOnError bool          `arg:"-e,--stop-on-error,help:stop all processes on any error. same as --halt now and fail=1."`
+	Halt        string        `arg:"--halt,help:stop after commands fail or succeed. given as 'now' or 'soon' then a comma then fail=N or fail=N% or done=N."`
+	DryRun      bool          `arg:"-d,--dry-run,help:print (but do not run) the commands."`
+	Log         string        `arg:"-l,--log,help:file to log commands. Successful commands are prefixed with '#'."`
+	Timeout     time.Duration `arg:"-t,--timeout,help:kill a command if it runs longer than this (e.g. 30s or 2h). default is no timeout."`
+	KillGrace   time.Duration `arg:"--kill-grace,help:time to wait after sending SIGTERM to a timed-out command before sending SIGKILL."`
+	Resume      string        `arg:"--resume,help:skip commands that succeeded according to this --log file. results are appended to it unless --log is given."`
+	JobLog      string        `arg:"--joblog,help:file to write metadata (start time; exit-code; bytes of output; etc.) for each command."`
+	JobLogFmt   string        `arg:"--joblog-format,help:format of --joblog: tsv or jsonl."`
+	Summary     string        `arg:"--summary,help:print a summary of the run (counts; durations; spilled output) to stderr as text or json."`
+	Command     string        `arg:"positional,required,help:command template to fill and execute."`
+	log         *os.File      `arg:"-"`
+	// commands that succeeded in the log given to --resume.
+	succeeded map[string]bool `arg:"-"`
+	joblog    *jobLog         `arg:"-"`
+	retryOn   []int           `arg:"-"`
+	noRetryOn []int           `arg:"-"`
+	halt      *haltPolicy     `arg:"-"`
+	jobs      *jobs           `arg:"-"`
+
+	// template for the prefix of each line of output with --tag.
+	tagTmpl *fasttemplate.Template `arg:"-"`
+	// template for the name of the directory of each command with --results.
+	resultsTmpl *fasttemplate.Template `arg:"-"`
+	// templates for the outputs and inputs of each command with --creates and --depends.
+	createsTmpls []*fasttemplate.Template `arg:"-"`
+	dependsTmpls []*fasttemplate.Template `arg:"-"`
+	// templates for the files that are part of the --cache key.
+	cacheTmpls []*fasttemplate.Template `arg:"-"`
+	cache      *process.Cache           `arg:"-"`
+}
+
+// job holds the input used to fill the template for a command.
+type job struct {
+	cmd   string
+	lines []string
+	// tag is the prefix for each line of output with --tag.
+	tag string
+	// key is the name of the directory for the output with --results.
+	key string
+	// the paths from --creates and --depends.
+	creates []string
+	depends []string
+	// the paths from --cache-inputs.
+	cacheInputs []string
+	// upToDate is set when the command is skipped because its outputs are newer than its inputs.
+	upToDate bool
+	// modification times of the --creates paths that existed before the command ran.
+	created map[string]time.Time
+}
+
+// jobs tracks the input of each command sent to the Runner until its result is received.
+// Commands are indexed in the order they are sent which matches $PROCESS_I.
+type jobs struct {
+	sync.Mutex
+	m map[int]*job
+	n int
+}
+
+func newJobs() *jobs {
+	return &jobs{m: make(map[int]*job)}
+}
+
+// add records the job for the next command to be sent.
+func (js *jobs) add(j *job) {
+	js.Lock()
+	js.m[js.n] = j
+	js.n++
+	js.Unlock()
+}
+
+// pop returns and forgets the job for the command with index i.
+func (js *jobs) pop(i int) *job {
+	js.Lock()
+	defer js.Unlock()
+	j := js.m[i]
+	delete(js.m, i)
+	return j
+}
+
+// sent returns the number of commands that have been sent to the Runner.
+func (js *jobs) sent() int {
+	js.Lock()
+	defer js.Unlock()
+	return js.n
+}
+
+// get returns the job for the command with index i.
+func (js *jobs) get(i int) *job {
+	js.Lock()
+	defer js.Unlock()
+	return js.m[i]
+}
+
+// rest returns and forgets the jobs that remain, in the order they were added.
+func (js *jobs) rest() []*job {
+	js.Lock()
+	defer js.Unlock()
+	idx := make([]int, 0, len(js.m))
+	for i := range js.m {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	rest := make([]*job, 0, len(idx))
+	for _, i := range idx {
+		rest = append(rest, js.m[i])
+		delete(js.m, i)
+	}
+	return rest
 }
 
 // Version string for go-args
@@ -57,109 +191,307 @@ func isStdin() bool {
 }
 
 func main() {
-	args := Params{Procs: 1, Nlines: 1}
+	args := Params{Procs: 1, Nlines: 1, KillGrace: process.DefaultKillGrace, JobLogFmt: "tsv"}
 	p := arg.MustParse(&args)
-	if args.Sep != "" && args.Nlines > 1 {
-		p.Fail("must specify either sep (-s) or n-lines (-n), not both")
+	if args.JobLogFmt != "tsv" && args.JobLogFmt != "jsonl" {
+		p.Fail("--joblog-format must be tsv or jsonl")
+	}
+	if args.Summary != "" && args.Summary != "text" && args.Summary != "json" {
+		p.Fail("--summary must be text or json")
+	}
+	if args.JSONL {
+		if args.CSV || args.Sep != "" || args.Header {
+			p.Fail("--jsonl can not be used with --csv; --sep (-s) or --header")
+		}
+	} else if args.CSV {
+		if args.Null || args.RecordSep != "" {
+			p.Fail("--csv can not be used with --null (-0) or --record-sep")
+		}
+		if args.Sep == "" {
+			args.Sep = ","
+		} else if sep, err := strconv.Unquote(`"` + args.Sep + `"`); err != nil || utf8.RuneCountInString(sep) != 1 {
+			p.Fail("--sep must be a single character with --csv")
+		} else {
+			args.Sep = sep
+		}
 	}
 	// if neither is specified then we default to whitespace
-	if args.Nlines == 1 && args.Sep == "" {
+	if args.Nlines == 1 && args.Sep == "" && !args.JSONL {
 		args.Sep = "\\s+"
 	}
+	if args.Header && args.Sep == "" {
+		p.Fail("--header requires that lines are split with --sep (-s) or --csv")
+	}
+	if args.Null {
+		if args.RecordSep != "" {
+			p.Fail("must specify either --null (-0) or --record-sep, not both")
+		}
+		args.RecordSep = "\x00"
+	} else if args.RecordSep != "" {
+		if rs, err := strconv.Unquote(`"` + args.RecordSep + `"`); err == nil {
+			args.RecordSep = rs
+		}
+	}
+	if args.Progress && args.NoProgress {
+		p.Fail("must specify either --progress or --no-progress, not both")
+	}
+	if args.LineBuffer && args.Ordered {
+		p.Fail("must specify either --line-buffer or --ordered (-o), not both")
+	}
+	if len(args.Depends) > 0 && len(args.Creates) == 0 {
+		p.Fail("--depends requires --creates")
+	}
+	for _, c := range args.Creates {
+		args.createsTmpls = append(args.createsTmpls, newTmpl(c))
+	}
+	for _, d := range args.Depends {
+		args.dependsTmpls = append(args.dependsTmpls, newTmpl(d))
+	}
+	if args.Cache == "" && (args.CacheSize != "" || len(args.CacheEnv) > 0 || len(args.CacheInputs) > 0) {
+		p.Fail("--cache-size; --cache-env and --cache-inputs require --cache")
+	}
+	if args.Cache != "" {
+		if args.LineBuffer {
+			p.Fail("--cache can not be used with --line-buffer")
+		}
+		if args.CacheSize == "" {
+			args.CacheSize = "1G"
+		}
+		size, err := parseSize(args.CacheSize)
+		if err != nil {
+			p.Fail("--cache-size: " + err.Error())
+		}
+		for _, c := range args.CacheInputs {
+			args.cacheTmpls = append(args.cacheTmpls, newTmpl(c))
+		}
+		if !args.DryRun {
+			args.cache, err = process.NewCache(args.Cache, size)
+			check(err)
+		}
+	}
+	if args.ResultsKey != "" && args.Results == "" {
+		p.Fail("--results-key requires --results")
+	}
+	if args.Results != "" {
+		if args.LineBuffer || args.Tag || args.TagTemplate != "" {
+			p.Fail("--results can not be used with --line-buffer or --tag")
+		}
+		if args.ResultsKey == "" {
+			args.ResultsKey = "{PROCESS_I}"
+		}
+		args.resultsTmpl = newTmpl(args.ResultsKey)
+		if !args.DryRun {
+			check(os.MkdirAll(args.Results, 0755))
+		}
+	}
+	if args.Tag || args.TagTemplate != "" {
+		if args.TagTemplate == "" {
+			args.TagTemplate = "{}\t"
+		}
+		if t, err := strconv.Unquote(`"` + args.TagTemplate + `"`); err == nil {
+			args.TagTemplate = t
+		}
+		args.tagTmpl = newTmpl(args.TagTemplate)
+	}
+	if args.StopOnError {
+		if args.Halt != "" {
+			p.Fail("must specify either --stop-on-error (-e) or --halt, not both")
+		}
+		args.Halt = "now,fail=1"
+	}
+	if args.Halt != "" {
+		var err error
+		if args.halt, err = parseHalt(args.Halt); err != nil {
+			p.Fail("--halt: " + err.Error())
+		}
+	}
+	if codes, err := parseCodes(args.RetryOn); err != nil {
+		p.Fail("--retry-on: " + err.Error())
+	} else {
+		args.retryOn = codes
+	}
+	if codes, err := parseCodes(args.NoRetryOn); err != nil {
+		p.Fail("--no-retry-on: " + err.Error())
+	} else {
+		args.noRetryOn = codes
+	}
+	if args.NoShell && args.Shell != "" {
+		p.Fail("must specify either --shell or --no-shell, not both")
+	}
+	if !args.NoShell {
+		if args.Shell == "" {
+			args.Shell = process.DefaultShell()
+		}
+		if err := process.CheckShell(args.Shell); err != nil {
+			fmt.Fprintln(os.Stderr, color.RedString("ERROR: unable to use shell: %s", err))
+			os.Exit(255)
+		}
+		switch filepath.Base(args.Shell) {
+		case "fish", "csh", "tcsh":
+			fmt.Fprintf(os.Stderr, "gargs: warning: using %s which does not accept bash syntax. use --shell to choose another.\n", args.Shell)
+		}
+		if args.Verbose {
+			fmt.Fprintf(os.Stderr, "gargs: using shell: %s\n", args.Shell)
+		}
+	}
 	if !isStdin() {
 		fmt.Fprintln(os.Stderr, color.RedString("ERROR: expecting input on STDIN"))
 		os.Exit(255)
 	}
-	if args.Log != "" {
+	if args.Resume != "" {
+		var err error
+		args.succeeded, err = readSucceeded(args.Resume)
+		check(err)
+		if args.Log == "" {
+			args.Log = args.Resume
+		}
+	}
+	if args.DryRun {
+		// nothing is run so the --log (which may be the --resume log) is left alone.
+	} else if args.Log == args.Resume && args.Log != "" {
+		var err error
+		args.log, err = os.OpenFile(args.Log, os.O_APPEND|os.O_WRONLY, 0644)
+		check(err)
+	} else if args.Log != "" {
 		var err error
 		args.log, err = os.Create(args.Log)
 		check(err)
 	}
-	runtime.GOMAXPROCS(args.Procs)
+	if args.JobLog != "" {
+		var err error
+		args.joblog, err = newJobLog(args.JobLog, args.JobLogFmt)
+		check(err)
+	}
+	args.jobs = newJobs()
 	run(args)
 	os.Exit(ExitCode)
 }
 
+// parseCodes parses a comma-separated list of exit codes.
+func parseCodes(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var codes []int
+	for _, f := range strings.Split(s, ",") {
+		c, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit code: %q", f)
+		}
+		codes = append(codes, c)
+	}
+	return codes, nil
+}
+
 func check(e error) {
 	if e != nil {
 		log.Fatal(e)
 	}
 }
 
-func handleCommand(args *Params, cmd string, ch chan string) {
+// handleCommand sends the command of j to ch (or prints it with --dry-run).
+// It returns false if stop was closed first.
+func handleCommand(args *Params, j *job, ch chan string, stop <-chan struct{}) bool {
 	if args.DryRun {
-		fmt.Fprintf(os.Stdout, "%s\n", cmd)
-		return
-	}
-	ch <- cmd
-}
-
-func fillTmplMap(toks []string, line string) map[string]interface{} {
-	m := make(map[string]interface{}, 5)
-	if toks != nil {
-		for i, t := range toks {
-			m[strconv.FormatInt(int64(i), 10)] = t
+		if args.succeeded[j.cmd] || upToDate(j) {
+			return true
 		}
+		fmt.Fprintf(os.Stdout, "%s\n", j.cmd)
+		return true
+	}
+	args.jobs.add(j)
+	select {
+	case ch <- j.cmd:
+		return true
+	case <-stop:
+		return false
 	}
-	m["Line"] = line
-	return m
 }
 
-func getScanner() *bufio.Scanner {
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Buffer(make([]byte, 0, 16384), 5e9)
-	return scanner
+// inputError exits with err and the line number(s) of the input records that caused it.
+func inputError(recs []*record, err error) {
+	if len(recs) > 1 {
+		log.Fatalf("input lines %d-%d: %s", recs[0].lineno, recs[len(recs)-1].lineno, err)
+	}
+	log.Fatalf("input line %d: %s", recs[0].lineno, err)
 }
 
-func genCommands(args *Params, tmpl *fasttemplate.Template) <-chan string {
+// genCommands reads the input and sends a command for each record (or -n records).
+// It stops reading the input when stop is closed.
+func genCommands(args *Params, tmpl *commandTmpl, stop <-chan struct{}) <-chan string {
 	ch := make(chan string)
-	var resep *regexp.Regexp
-	if args.Sep != "" {
-		resep = regexp.MustCompile(args.Sep)
-	}
+	rdr, err := newRecordReader(args)
+	check(err)
 
-	scanner := getScanner()
 	go func() {
-		var lines []string
-		if resep == nil {
-			lines = make([]string, 0, args.Nlines)
+		var header []string
+		if args.Header {
+			h, err := rdr.Read()
+			if err != io.EOF {
+				check(err)
+				header = h.fields
+			}
 		}
+		recs := make([]*record, 0, args.Nlines)
 		var buf bytes.Buffer
-		for scanner.Scan() {
+		// index of the next command. this is its $PROCESS_I.
+		n := 0
+		send := func() bool {
 			buf.Reset()
-			line := scanner.Text()
-			serr := scanner.Err()
-			if serr == nil || (serr == io.EOF && len(line) > 0) {
-				if resep != nil {
-					toks := resep.Split(line, -1)
-					targs := fillTmplMap(toks, line)
-					_, err := tmpl.Execute(&buf, targs)
-					check(err)
-					handleCommand(args, buf.String(), ch)
-				} else {
-					lines = append(lines, line)
+			targs := fillTmplMap(recs, args.Nlines, header)
+			targs["PROCESS_I"] = strconv.Itoa(n)
+			n++
+			if err := tmpl.fill(&buf, targs); err != nil {
+				inputError(recs, err)
+			}
+			j := &job{cmd: buf.String(), lines: make([]string, 0, len(recs))}
+			for _, r := range recs {
+				j.lines = append(j.lines, r.line)
+			}
+			// render fills the other templates (which are not quoted for the shell).
+			render := func(t *fasttemplate.Template) string {
+				buf.Reset()
+				if err := fillTmpl(&buf, t, targs, args.JSONL, false); err != nil {
+					inputError(recs, err)
 				}
-			} else {
-				if serr == io.EOF {
-					break
+				return buf.String()
+			}
+			if args.tagTmpl != nil {
+				j.tag = render(args.tagTmpl)
+			}
+			if args.resultsTmpl != nil {
+				j.key = render(args.resultsTmpl)
+				if err := checkResultsKey(j.key); err != nil {
+					inputError(recs, err)
 				}
-				log.Fatal(serr)
 			}
-			if len(lines) >= args.Nlines {
-				targs := fillTmplMap(lines, strings.Join(lines, " "))
-				_, err := tmpl.Execute(&buf, targs)
-				check(err)
-				lines = lines[:0]
-				handleCommand(args, buf.String(), ch)
+			for _, t := range args.createsTmpls {
+				j.creates = append(j.creates, render(t))
+			}
+			for _, t := range args.dependsTmpls {
+				j.depends = append(j.depends, render(t))
 			}
+			for _, t := range args.cacheTmpls {
+				j.cacheInputs = append(j.cacheInputs, render(t))
+			}
+			recs = recs[:0]
+			return handleCommand(args, j, ch, stop)
 		}
-		if len(lines) > 0 {
-			targs := fillTmplMap(lines, strings.Join(lines, " "))
-			_, err := tmpl.Execute(&buf, targs)
+		defer close(ch)
+		for !isClosed(stop) {
+			r, err := rdr.Read()
+			if err == io.EOF {
+				break
+			}
 			check(err)
-			handleCommand(args, buf.String(), ch)
+			recs = append(recs, r)
+			if len(recs) >= args.Nlines && !send() {
+				return
+			}
+		}
+		if len(recs) > 0 && !isClosed(stop) {
+			send()
 		}
-		close(ch)
 	}()
 	return ch
 }
@@ -187,36 +519,184 @@ func init() {
 
 func run(args Params) {
 
-	tmpl := makeCommandTmpl(args.Command)
-	cmds := genCommands(&args, tmpl)
+	tmpl, err := newCommandTmpl(&args)
+	check(err)
+	// closed to stop reading the input once --halt is met.
+	halted := make(chan struct{})
+	cmds := genCommands(&args, tmpl, halted)
 
-	stdout := bufio.NewWriter(os.Stdout)
+	var prog *progress
+	if showProgress(&args, isatty.IsTerminal(os.Stderr.Fd())) {
+		prog = newProgress(os.Stderr, args.Total, args.Procs, args.jobs.sent)
+	}
+	// output is written through prog so that the progress line is cleared first.
+	stderr := prog.writer(os.Stderr)
+	stdout := bufio.NewWriter(prog.writer(os.Stdout))
 	defer stdout.Flush()
 
-	cancel := make(chan bool)
-	defer close(cancel)
-	fails := 0
+	var sum *summary
+	if args.Summary != "" && !args.DryRun {
+		sum = newSummary()
+	}
+
+	// with --halt now, cancel kills the running commands and stops new ones from starting.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if h := args.halt; h != nil {
+		if h.now {
+			h.stop = func() {
+				close(halted)
+				cancel()
+			}
+		} else {
+			// let running commands finish but send no more to the runner.
+			h.stop = func() { close(halted) }
+			cmds = gate(cmds, halted)
+		}
+	}
+	fails, killed, notStarted := 0, 0, 0
 
 	// flush stdout every 2 seconds.
 	last := time.Now().Add(2 * time.Second)
-	opts := process.Options{Retries: args.Retry, Ordered: args.Ordered}
-	for p := range process.Runner(cmds, cancel, &opts) {
+	opts := process.Options{Retries: args.Retry, RetryDelay: args.RetryDelay, RetryMaxDelay: args.RetryMax,
+		RetryOn: args.retryOn, NoRetryOn: args.noRetryOn, Ordered: args.Ordered, Timeout: args.Timeout, KillGrace: args.KillGrace,
+		Procs: args.Procs, NoShell: args.NoShell, Shell: args.Shell}
+	if args.cache != nil {
+		opts.Cache = args.cache
+		opts.CacheKey = cacheKey(&args)
+	}
+	if args.LineBuffer {
+		lineOut := prog.writer(os.Stdout)
+		opts.LineFunc = func(i int, line []byte) {
+			if args.tagTmpl != nil {
+				if j := args.jobs.get(i); j != nil {
+					line = append([]byte(j.tag), line...)
+				}
+			}
+			_, err := lineOut.Write(line)
+			check(err)
+		}
+	}
+	// count commands as soon as they finish rather than when their output is written (which may be later with -o).
+	var finished []func(*process.Command)
+	if args.halt != nil {
+		finished = append(finished, args.halt.add)
+	}
+	if prog != nil {
+		finished = append(finished, prog.add)
+	}
+	if len(finished) > 0 {
+		opts.Finished = func(c *process.Command) {
+			for _, f := range finished {
+				f(c)
+			}
+		}
+	}
+	// with --halt soon, commands that the runner has already read are skipped once it is halted.
+	soon := args.halt != nil && !args.halt.now
+	if args.succeeded != nil || soon || len(args.Creates) > 0 {
+		opts.Skip = func(i int, cmd string) bool {
+			if args.succeeded[cmd] || (soon && args.halt.Halted()) {
+				return true
+			}
+			// checked as late as possible so that outputs created by earlier commands are seen.
+			j := args.jobs.get(i)
+			if j == nil {
+				return false
+			}
+			if upToDate(j) {
+				j.upToDate = true
+				return true
+			}
+			j.created = modTimes(j.creates)
+			return false
+		}
+	}
+	// total resources used by all commands. reported with --verbose.
+	var usage process.Usage
+	nusage := 0
+	for p := range process.RunnerContext(ctx, cmds, &opts) {
+		j := args.jobs.pop(p.Index)
+		if p.Skipped && j.upToDate {
+			if prog != nil {
+				prog.skip()
+			}
+			if sum != nil {
+				sum.skip()
+			}
+			if args.Verbose {
+				fmt.Fprintf(stderr, "%s\n", p)
+			}
+			args.logSkipped(p.CmdStr)
+			continue
+		}
+		if p.Skipped && args.succeeded[p.CmdStr] {
+			if prog != nil {
+				prog.skip()
+			}
+			if sum != nil {
+				sum.skip()
+			}
+			if args.Verbose {
+				fmt.Fprintf(stderr, "%s\n", p)
+			}
+			// already logged as successful in the --resume log. a new --log must also have it
+			// so that it can be used with --resume.
+			if args.Log != args.Resume {
+				args.logSkipped(p.CmdStr)
+			}
+			continue
+		}
+		if p.Skipped || (!p.Killed && errors.Is(p.Err, context.Canceled)) {
+			// read by the runner after it was halted so it was never started.
+			notStarted++
+			args.logNotStarted(p.CmdStr)
+			if sum != nil {
+				sum.notStarted()
+			}
+			continue
+		}
 
+		// write stderr of each command as a single block so that it isn't
+		// interleaved with the stderr of other commands.
+		if p.Stderr != nil && args.Results == "" {
+			_, err := io.Copy(tagWriter(stderr, j), p.Stderr)
+			check(err)
+		}
 		if ex := p.ExitCode(); ex != 0 {
+			// don't leave partial outputs that would cause the command to be skipped next time.
+			removeOutputs(j)
 			c := color.New(color.BgRed).Add(color.Bold)
-			fmt.Fprintf(os.Stderr, "%s\n", c.SprintFunc()(fmt.Sprintf("ERROR with command: %s", p)))
-			ExitCode = max(ExitCode, ex)
+			msg := "ERROR"
+			if p.TimedOut {
+				msg = "TIMEOUT"
+			} else if p.Killed {
+				msg = "KILLED"
+			}
+			fmt.Fprintf(stderr, "%s\n", c.SprintFunc()(fmt.Sprintf("%s with command: %s", msg, p)))
 			fails++
-			if args.StopOnError {
-				break
+			if p.Killed {
+				// killed because another command failed so it does not set the exit code.
+				killed++
+			} else {
+				ExitCode = max(ExitCode, ex)
 			}
 		}
 		if args.Verbose {
-			fmt.Fprintf(os.Stderr, "%s\n", p)
+			fmt.Fprintf(stderr, "%s\n", p)
+		}
+		if p.Usage != nil {
+			usage.Add(p.Usage)
+			nusage++
+		}
+		if sum != nil {
+			sum.add(p)
 		}
-		// reader can be nil if we couldn't even start the bash process
-		if p.Reader != nil {
-			_, err := io.Copy(stdout, p)
+		if args.Results != "" {
+			check(writeResults(args.Results, j.key, p))
+		} else if p.Reader != nil {
+			// reader can be nil if we couldn't even start the bash process
+			_, err := io.Copy(tagWriter(stdout, j), p)
 			check(err)
 		}
 
@@ -227,7 +707,23 @@ func run(args Params) {
 		}
 		if args.log != nil {
 			// if no error prefix the command with '#'
-			rtime := fmt.Sprintf(" #\t%.0fs\n", p.Duration.Seconds())
+			rtime := fmt.Sprintf(" #\t%.0fs", p.Duration.Seconds())
+			if u := p.Usage; u != nil {
+				rtime += fmt.Sprintf("\tuser=%.2fs\tsys=%.2fs\tmaxrss=%dKB", u.User.Seconds(), u.System.Seconds(), u.MaxRSS)
+			}
+			if len(p.Attempts) > 1 {
+				rtime += fmt.Sprintf("\ttries=%d", len(p.Attempts))
+			}
+			if p.TimedOut {
+				rtime += "\ttimeout"
+			}
+			if p.Killed {
+				rtime += "\tkilled"
+			}
+			if p.Cached {
+				rtime += "\tcached"
+			}
+			rtime += "\n"
 			if p.ExitCode() == 0 {
 				args.log.WriteString("# " + strings.Replace(p.CmdStr, "\n", "\n# ", -1) + rtime)
 			} else {
@@ -235,8 +731,41 @@ func run(args Params) {
 			}
 			stdout.Flush()
 		}
+		if args.joblog != nil {
+			check(args.joblog.write(p, j))
+		}
 	}
 	stdout.Flush()
+	if prog != nil {
+		prog.Close()
+	}
+	if args.halt != nil && args.halt.Halted() {
+		// commands that were generated but never reached the runner.
+		for _, j := range args.jobs.rest() {
+			if args.succeeded[j.cmd] {
+				if args.Log != args.Resume {
+					args.logSkipped(j.cmd)
+				}
+				continue
+			}
+			notStarted++
+			args.logNotStarted(j.cmd)
+			if sum != nil {
+				sum.notStarted()
+			}
+		}
+		fmt.Fprintf(stderr, "gargs: halted (--halt %s). %d running commands were killed and %d were not started.\n",
+			args.halt.spec, killed, notStarted)
+	}
+	if args.joblog != nil {
+		check(args.joblog.Close())
+	}
+	if args.Verbose && nusage > 0 {
+		fmt.Fprintf(stderr, "gargs: resources used by %d commands: %s\n", nusage, &usage)
+	}
+	if sum != nil {
+		check(sum.write(stderr, args.Summary))
+	}
 	if ExitCode == 0 && args.log != nil {
 		args.log.WriteString("# SUCCESS\n")
 	} else if args.log != nil {
@@ -245,7 +774,18 @@ func run(args Params) {
 
 }
 
-func makeCommandTmpl(cmd string) *fasttemplate.Template {
-	v := strings.Replace(cmd, "{}", "{Line}", -1)
-	return fasttemplate.New(v, "{", "}")
+// logSkipped writes a command that was skipped to the --log. It is prefixed with '#' so that
+// it is also skipped with --resume.
+func (args *Params) logSkipped(cmd string) {
+	if args.log != nil {
+		args.log.WriteString("# " + strings.Replace(cmd, "\n", "\n# ", -1) + " #\t0s\tskipped\n")
+	}
+}
+
+// logNotStarted writes a command that was not started because of --halt to the --log.
+// It is not prefixed with '#' so that it is run with --resume.
+func (args *Params) logNotStarted(cmd string) {
+	if args.log != nil {
+		args.log.WriteString(cmd + " #\t0s\tnot-started\n")
+	}
 }
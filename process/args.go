@@ -0,0 +1,59 @@
+package process
+
+import (
+	"errors"
+	"strings"
+)
+
+// SplitArgs splits s into words as a POSIX shell would without expansions. Words are separated by
+// unquoted whitespace. Within single quotes all characters are literal. Within double quotes a
+// backslash escapes only $, `, ", \ and newline. Elsewhere a backslash escapes the next character.
+// It is used to get the arguments of a command when Options.NoShell is set.
+func SplitArgs(s string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case ' ', '\t', '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case '\'':
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j == -1 {
+				return nil, errors.New("process: unterminated single quote in: " + s)
+			}
+			word.WriteString(s[i+1 : i+1+j])
+			i += j + 1
+		case '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) != -1 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errors.New("process: unterminated double quote in: " + s)
+			}
+		case '\\':
+			i++
+			if i == len(s) {
+				return nil, errors.New("process: trailing backslash in: " + s)
+			}
+			word.WriteByte(s[i])
+		default:
+			word.WriteByte(c)
+		}
+		inWord = true
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,266 @@
+package process
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache stores the output of commands that succeeded so that an identical command can be
+// replayed rather than run again. Entries are directories under Dir named by their key. When
+// the total size of the entries exceeds MaxSize, the least recently used are removed.
+type Cache struct {
+	Dir string
+	// MaxSize is the most bytes to keep in the cache. If it is 0, there is no limit.
+	MaxSize int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+// NewCache opens (creating if needed) a cache in dir.
+func NewCache(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{Dir: dir, MaxSize: maxSize}
+	entries, err := c.entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		c.size += e.size
+	}
+	return c, nil
+}
+
+// Key returns a key for the given parts (e.g. a command, environment variables and the contents of inputs).
+func Key(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		// the length makes the key unambiguous for any parts.
+		fmt.Fprintf(h, "%d:", len(p))
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, key)
+}
+
+// get returns the cached Command for key or nil if there is none.
+func (c *Cache) get(key, command string) *Command {
+	dir := c.path(key)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "exitcode"))
+	if err != nil {
+		return nil
+	}
+	if code, err := strconv.Atoi(strings.TrimSpace(string(b))); err != nil || code != 0 {
+		return nil
+	}
+	out, err := readCached(filepath.Join(dir, "stdout.gz"))
+	if err != nil {
+		return nil
+	}
+	serr, err := readCached(filepath.Join(dir, "stderr.gz"))
+	if err != nil {
+		cleanupOutput(out)
+		return nil
+	}
+	// the modification time of the entry is used to evict the least recently used.
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	cmd := newCommand(out, serr, command, nil)
+	cmd.Cached = true
+	cmd.Start = now
+	cmd.Attempts = []Attempt{{Start: now}}
+	return cmd
+}
+
+// readCached reads a gzipped file from the cache in the same way as the output of a command.
+func readCached(path string) (output, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return output{}, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return output{}, err
+	}
+	o := bufferOutput(gz)
+	return o, o.err
+}
+
+func cleanupOutput(o output) {
+	if o.tmp != nil {
+		o.tmp.Close()
+		os.Remove(o.tmp.Name())
+	}
+}
+
+// put stores the output of cmd with key. Storing reads the output of cmd so it is replaced
+// with a copy that is complete even if storing fails.
+func (c *Cache) put(key string, cmd *Command) error {
+	tmp, err := ioutil.TempDir(c.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	out, osize, oerr := storeOutput(filepath.Join(tmp, "stdout.gz"), cmd.Reader)
+	serr, ssize, eerr := storeOutput(filepath.Join(tmp, "stderr.gz"), cmd.Stderr)
+	cmd.Cleanup()
+	// newCommand may have set a finalizer for the old temp files.
+	runtime.SetFinalizer(cmd, nil)
+	cmd.Reader, cmd.tmp = out.Reader, out.tmp
+	cmd.Stderr, cmd.stderr = serr.Reader, serr.tmp
+	if cmd.tmp != nil || cmd.stderr != nil {
+		runtime.SetFinalizer(cmd, cleanup)
+	}
+	if out.err != nil || serr.err != nil {
+		// the output could not be read again so the command can not be trusted.
+		if cmd.Err = out.err; cmd.Err == nil {
+			cmd.Err = serr.err
+		}
+		return cmd.Err
+	}
+	if oerr != nil {
+		return oerr
+	}
+	if eerr != nil {
+		return eerr
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "exitcode"), []byte(fmt.Sprintf("%d\n", cmd.ExitCode())), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "cmd"), []byte(cmd.CmdStr+"\n"), 0644); err != nil {
+		return err
+	}
+	dir := c.path(key)
+	c.mu.Lock()
+	// the same command may have been stored by another gargs.
+	os.RemoveAll(dir)
+	if err := os.Rename(tmp, dir); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.size += osize + ssize
+	over := c.MaxSize > 0 && c.size > c.MaxSize
+	c.mu.Unlock()
+	if over {
+		c.evict()
+	}
+	return nil
+}
+
+// storeOutput reads r (which may be nil) into a new output while writing a gzipped copy to
+// path. The output is complete even if writing the copy fails. It returns the size of the file.
+func storeOutput(path string, r *bufio.Reader) (output, int64, error) {
+	w := &gzipFile{}
+	if w.f, w.err = os.Create(path); w.err == nil {
+		w.gz, _ = gzip.NewWriterLevel(w.f, gzip.BestSpeed)
+	}
+	var o output
+	if r != nil {
+		o = bufferOutput(io.TeeReader(r, w))
+	}
+	n, err := w.close()
+	return o, n, err
+}
+
+// gzipFile writes gzipped data to a file. After the first error, writes are discarded
+// rather than failing so that the reader of an io.TeeReader to it is not interrupted.
+type gzipFile struct {
+	f   *os.File
+	gz  *gzip.Writer
+	err error
+}
+
+func (w *gzipFile) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.gz.Write(p)
+	}
+	return len(p), nil
+}
+
+// close finishes the file and returns its size or the first error.
+func (w *gzipFile) close() (int64, error) {
+	if w.f == nil {
+		return 0, w.err
+	}
+	defer w.f.Close()
+	if w.err == nil {
+		w.err = w.gz.Close()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	fi, err := w.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+type cacheEntry struct {
+	path  string
+	size  int64
+	mtime time.Time
+}
+
+func (c *Cache) entries() ([]cacheEntry, error) {
+	dirs, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []cacheEntry
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		e := cacheEntry{path: filepath.Join(c.Dir, d.Name()), mtime: d.ModTime()}
+		files, _ := ioutil.ReadDir(e.path)
+		for _, f := range files {
+			e.size += f.Size()
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// evict removes the least recently used entries until the cache is smaller than MaxSize.
+func (c *Cache) evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.entries()
+	if err != nil {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mtime.Before(entries[j].mtime) })
+	c.size = 0
+	for _, e := range entries {
+		c.size += e.size
+	}
+	for _, e := range entries {
+		if c.size <= c.MaxSize {
+			break
+		}
+		if os.RemoveAll(e.path) == nil {
+			c.size -= e.size
+		}
+	}
+}
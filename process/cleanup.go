@@ -6,9 +6,38 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 )
 
+// running holds the processes that are currently executing. Each leads its own
+// process group so they would not otherwise see signals sent to gargs from the terminal.
+var running = struct {
+	sync.Mutex
+	m map[int]*os.Process
+}{m: make(map[int]*os.Process)}
+
+func addRunning(p *os.Process) {
+	running.Lock()
+	running.m[p.Pid] = p
+	running.Unlock()
+}
+
+func removeRunning(p *os.Process) {
+	running.Lock()
+	delete(running.m, p.Pid)
+	running.Unlock()
+}
+
+// signalRunning sends sig to the process group of every running command.
+func signalRunning(sig syscall.Signal) {
+	running.Lock()
+	defer running.Unlock()
+	for _, p := range running.m {
+		signalGroup(p, sig)
+	}
+}
+
 // Cleanup is a best-effort to remove all temporary files
 // created by process. Users can call it manually to remove them.
 func Cleanup() {
@@ -30,6 +59,9 @@ func init() {
 		syscall.SIGQUIT)
 	go func() {
 		s := <-c
+		if sig, ok := s.(syscall.Signal); ok {
+			signalRunning(sig)
+		}
 		Cleanup()
 		fmt.Fprintln(os.Stderr, s)
 		os.Exit(2)
@@ -1,9 +1,10 @@
-// +build !linux
+// +build !linux,!windows
 
 package process
 
 import "syscall"
 
 func getSysProc() *syscall.SysProcAttr {
-	return nil
+	// run in a new process group so that a command and its children can be signalled together.
+	return &syscall.SysProcAttr{Setpgid: true}
 }
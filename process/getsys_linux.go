@@ -5,5 +5,6 @@ package process
 import "syscall"
 
 func getSysProc() *syscall.SysProcAttr {
-	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGABRT}
+	// run in a new process group so that a command and its children can be signalled together.
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGABRT, Setpgid: true}
 }
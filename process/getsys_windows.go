@@ -0,0 +1,9 @@
+// +build windows
+
+package process
+
+import "syscall"
+
+func getSysProc() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,14 @@
+// +build windows
+
+package process
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalGroup kills p. windows has no process groups or SIGTERM so any
+// signal is treated as a kill.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	return p.Kill()
+}
@@ -4,9 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/exec"
 	"runtime"
@@ -26,10 +29,18 @@ var WaitingMultiplier = 4
 // UnknownExit is used when the return/exit-code of the command is not known.
 const UnknownExit = 1
 
+// TimeoutExit is the exit code reported for a command that was killed because it exceeded Options.Timeout.
+const TimeoutExit = 124
+
+// DefaultKillGrace is used when Options.KillGrace is not set.
+const DefaultKillGrace = 5 * time.Second
+
 // prefix for tmp files.
 var prefix = fmt.Sprintf("gargs.%d.", os.Getpid())
 
-func getShell() string {
+// DefaultShell is the shell used to run commands when Options.Shell is not set.
+// It is $SHELL if set, otherwise bash if it exists or sh.
+func DefaultShell() string {
 	shell := os.Getenv("SHELL")
 	if shell == "" {
 		if _, err := os.Stat("/bin/bash"); err == nil {
@@ -41,13 +52,64 @@ func getShell() string {
 	return shell
 }
 
+// CheckShell returns an error if shell can not be found or fails to run an empty command with -c.
+func CheckShell(shell string) error {
+	path, err := exec.LookPath(shell)
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command(path, "-c", "").CombinedOutput(); err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			return fmt.Errorf("process: %s -c failed: %s: %s", shell, err, out)
+		}
+		return fmt.Errorf("process: %s -c failed: %s", shell, err)
+	}
+	return nil
+}
+
 // Command contains a buffered reader with the realized stdout of the process along with the exit code.
+// The stderr of the process is buffered in the same way and is available from Stderr.
 type Command struct {
 	*bufio.Reader
 	tmp      *os.File
+	Stderr   *bufio.Reader
+	stderr   *os.File
 	Err      error
 	CmdStr   string
 	Duration time.Duration
+	// Index is the (0-based) order in which Runner received the command. It is also set as $PROCESS_I.
+	Index int
+	// Start is the time that the (first attempt of the) command was started.
+	Start time.Time
+	// Retries is the number of times the command was retried.
+	Retries int
+	// StdoutBytes and StderrBytes are the number of bytes written to stdout and stderr.
+	// StderrBytes includes the output of all attempts.
+	StdoutBytes int64
+	StderrBytes int64
+	// Usage is the resources used by all attempts of the command. It is nil if the command
+	// was not started or if this is not available on the current platform.
+	Usage *Usage
+	// TimedOut indicates that the command was killed because it ran longer than Options.Timeout.
+	TimedOut bool
+	// Killed indicates that the command was killed because its context was cancelled.
+	Killed bool
+	// Skipped indicates that the command was not run because Options.Skip returned true.
+	Skipped bool
+	// Attempts has an entry for each time the command was run, including retries.
+	Attempts []Attempt
+	// Cached indicates that the output was replayed from Options.Cache instead of running the command.
+	Cached bool
+	// failed attempts of this command. kept so their stderr can be read
+	// and their tmp files cleaned.
+	retried []*Command
+}
+
+// Attempt records a single run of a Command.
+type Attempt struct {
+	Start    time.Time
+	Duration time.Duration
+	ExitCode int
 }
 
 func (c *Command) error() string {
@@ -57,12 +119,21 @@ func (c *Command) error() string {
 	return c.Err.Error()
 }
 
-// Close the temp file associated with the command
+// Close the temp files associated with the command
 func (c *Command) Close() error {
-	if c.tmp == nil {
-		return nil
+	var err error
+	for _, r := range c.retried {
+		r.Close()
 	}
-	return c.tmp.Close()
+	if c.tmp != nil {
+		err = c.tmp.Close()
+	}
+	if c.stderr != nil {
+		if e := c.stderr.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 // String returns a representation of the command that includes run-time, error (if any) and the first 20 chars of stdout.
@@ -91,40 +162,109 @@ func (c *Command) String() string {
 	if ex := c.ExitCode(); ex != 0 {
 		exString = fmt.Sprintf(", exit-code: %d", ex)
 	}
+	if c.TimedOut {
+		exString += ", timed-out"
+	}
+	if c.Killed {
+		exString += ", killed"
+	}
+	if c.Cached {
+		exString += ", cached"
+	}
+	if c.Skipped {
+		exString += ", skipped"
+	}
+	usage := ""
+	if c.Usage != nil {
+		usage = ", " + c.Usage.String()
+	}
 
-	return fmt.Sprintf("Command('%s', %s%s%s, run-time: %s)",
-		cmd, prompt, exString, errString, c.Duration)
+	return fmt.Sprintf("Command('%s', %s%s%s, run-time: %s%s)",
+		cmd, prompt, exString, errString, c.Duration, usage)
 }
 
-// ExitCode returns the exit code associated with a given error
+// ExitCode returns the exit code associated with a given error.
+// If the command timed out, it is TimeoutExit. If it was terminated by a signal, it is 128 + the signal number.
 func (c *Command) ExitCode() int {
+	if c.TimedOut {
+		return TimeoutExit
+	}
 	if c.Err == nil {
 		return 0
 	}
 	if ex, ok := c.Err.(*exec.ExitError); ok {
 		if st, ok := ex.Sys().(syscall.WaitStatus); ok {
+			if st.Signaled() {
+				return 128 + int(st.Signal())
+			}
 			return st.ExitStatus()
 		}
 	}
 	return UnknownExit
 }
 
-// Cleanup makes sure the tempfile is closed an deleted.
-func (c *Command) Cleanup() {
+// Signal returns the signal that terminated the process or 0 if it exited normally.
+func (c *Command) Signal() syscall.Signal {
+	if ex, ok := c.Err.(*exec.ExitError); ok {
+		if st, ok := ex.Sys().(syscall.WaitStatus); ok && st.Signaled() {
+			return st.Signal()
+		}
+	}
+	return 0
+}
+
+// Spilled indicates whether the output was too large for memory and was written to a temp file.
+func (c *Command) Spilled() bool {
+	for _, r := range c.retried {
+		if r.Spilled() {
+			return true
+		}
+	}
+	return c.tmp != nil || c.stderr != nil
+}
+
+// SpilledBytes is the number of bytes of output (before compression) that were written to temp files.
+func (c *Command) SpilledBytes() int64 {
+	var n int64
+	// StderrBytes includes the stderr of the retried attempts.
+	stderr := c.StderrBytes
+	for _, r := range c.retried {
+		n += r.SpilledBytes()
+		stderr -= r.StderrBytes
+	}
 	if c.tmp != nil {
+		n += c.StdoutBytes
+	}
+	if c.stderr != nil {
+		n += stderr
+	}
+	return n
+}
+
+// Cleanup makes sure the tempfiles are closed an deleted.
+func (c *Command) Cleanup() {
+	for _, r := range c.retried {
+		r.Cleanup()
+	}
+	if c.tmp != nil || c.stderr != nil {
 		c.Close()
 		cleanup(c)
 	}
 }
 
 func cleanup(c *Command) {
-	c.tmp.Close()
-	os.Remove(c.tmp.Name())
+	for _, f := range []*os.File{c.tmp, c.stderr} {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
 }
 
-func newCommand(rdr *bufio.Reader, tmp *os.File, cmd string, err error) *Command {
-	c := &Command{rdr, tmp, err, cmd, 0}
-	if tmp != nil {
+func newCommand(out, serr output, cmd string, err error) *Command {
+	c := &Command{Reader: out.Reader, tmp: out.tmp, Stderr: serr.Reader, stderr: serr.tmp, Err: err, CmdStr: cmd,
+		StdoutBytes: out.n, StderrBytes: serr.n}
+	if c.tmp != nil || c.stderr != nil {
 		runtime.SetFinalizer(c, cleanup)
 	}
 	return c
@@ -139,34 +279,128 @@ type CallBack func(io.Reader, io.WriteCloser) error
 // Blocks until the output is finished and returns a *Command
 // that is an io.Reader. See Options for additional details.
 func Run(command string, opts *Options, env ...string) *Command {
+	return RunContext(context.Background(), command, opts, env...)
+}
+
+// RunContext is like Run but the process group of the command is killed if ctx is
+// cancelled before it finishes. In that case, the returned Command has Killed set and
+// its Err is ctx.Err(). If ctx is already done, the command is not started.
+func RunContext(ctx context.Context, command string, opts *Options, env ...string) *Command {
+	return runContext(ctx, command, opts, -1, env)
+}
+
+// runContext implements RunContext. i is the index of the command for Options.LineFunc.
+func runContext(ctx context.Context, command string, opts *Options, i int, env []string) *Command {
 	t := time.Now()
-	var c *Command
-	var retries int
 	if opts == nil {
-		c = oneRun(command, nil, env)
-	} else {
-		c = oneRun(command, opts.CallBack, env)
-		retries = opts.Retries
+		opts = &Options{}
 	}
-	for retries > 0 && c.ExitCode() != 0 {
-		retries--
-		c = oneRun(command, opts.CallBack, env)
+	attempt := func() *Command {
+		start := time.Now()
+		c := oneRun(ctx, command, opts, i, env)
+		c.Attempts = append(c.Attempts, Attempt{Start: start, Duration: time.Since(start), ExitCode: c.ExitCode()})
+		return c
 	}
+	c := attempt()
+	var retried []*Command
+	var attempts []Attempt
+	for len(retried) < opts.Retries && opts.retry(c.ExitCode()) && ctx.Err() == nil {
+		if d := opts.retryDelay(len(retried) + 1); d > 0 {
+			if sleep(ctx, d); ctx.Err() != nil {
+				break
+			}
+		}
+		retried = append(retried, c)
+		attempts = append(attempts, c.Attempts...)
+		c = attempt()
+	}
+	if len(attempts) > 0 {
+		c.Attempts = append(attempts, c.Attempts...)
+	}
+	if len(retried) > 0 {
+		// report the stderr from every attempt, not just the last.
+		rdrs := make([]io.Reader, 0, len(retried)+1)
+		for _, r := range retried {
+			if r.Stderr != nil {
+				rdrs = append(rdrs, r.Stderr)
+			}
+		}
+		if c.Stderr != nil {
+			rdrs = append(rdrs, c.Stderr)
+		}
+		c.Stderr = bufio.NewReader(io.MultiReader(rdrs...))
+		c.retried = retried
+		c.Retries = len(retried)
+		for _, r := range retried {
+			c.StderrBytes += r.StderrBytes
+			if r.Usage != nil && c.Usage != nil {
+				c.Usage.Add(r.Usage)
+			}
+		}
+	}
+	c.Start = t
 	c.Duration = time.Since(t)
 	return c
 }
 
+// runI runs a command from Runner with PROCESS_I set to its index
+// unless Options.Skip says it should be skipped.
+func runI(ctx context.Context, command istring, opts *Options) *Command {
+	if opts.Skip != nil && opts.Skip(command.i, command.string) {
+		c := newCommand(output{}, output{}, command.string, nil)
+		c.Skipped = true
+		c.Index = command.i
+		return c
+	}
+	var key string
+	if opts.Cache != nil && opts.LineFunc == nil {
+		key = opts.cacheKey(command.i, command.string)
+	}
+	var c *Command
+	if key != "" {
+		c = opts.Cache.get(key, command.string)
+	}
+	if c == nil {
+		c = runContext(ctx, command.string, opts, command.i, []string{fmt.Sprintf("PROCESS_I=%d", command.i)})
+		if key != "" && c.ExitCode() == 0 {
+			// failing to store the output does not change the result of the command.
+			opts.Cache.put(key, c)
+		}
+	}
+	c.Index = command.i
+	if opts.Finished != nil {
+		opts.Finished(c)
+	}
+	return c
+}
+
 // oRun calls run and sends result to channel. used when we want
 // to keep output in same order as input
-func oRun(command istring, opts *Options, env ...string) {
-	cmd := Run(command.string, opts, env...)
+func oRun(ctx context.Context, command istring, opts *Options) {
+	cmd := runI(ctx, command, opts)
 	command.ch <- cmd
 	close(command.ch)
 }
 
-func oneRun(command string, callback CallBack, env []string) *Command {
+func oneRun(ctx context.Context, command string, opts *Options, i int, env []string) *Command {
+	if err := ctx.Err(); err != nil {
+		return newCommand(output{}, output{}, command, err)
+	}
+	callback := opts.CallBack
 
-	cmd := exec.Command(getShell(), "-c", command)
+	var cmd *exec.Cmd
+	if opts.NoShell {
+		argv, err := SplitArgs(command)
+		if err == nil && len(argv) == 0 {
+			err = errors.New("process: empty command")
+		}
+		if err != nil {
+			return newCommand(output{}, output{}, command, err)
+		}
+		cmd = exec.Command(argv[0], argv[1:]...)
+	} else {
+		cmd = exec.Command(opts.shell(), "-c", command)
+	}
 	if len(env) > 0 {
 		cmd.Env = os.Environ()
 		cmd.Env = append(cmd.Env, env...)
@@ -178,9 +412,14 @@ func oneRun(command string, callback CallBack, env []string) *Command {
 
 	spipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return newCommand(nil, nil, command, err)
+		return newCommand(output{}, output{}, command, err)
 	}
 	defer spipe.Close()
+	epipe, err := cmd.StderrPipe()
+	if err != nil {
+		return newCommand(output{}, output{}, command, err)
+	}
+	defer epipe.Close()
 	var errch chan error
 	if callback != nil {
 		errch = make(chan error, 1)
@@ -197,69 +436,208 @@ func oneRun(command string, callback CallBack, env []string) *Command {
 	} else {
 		opipe = spipe
 	}
+
+	err = cmd.Start()
 	if err != nil {
-		return newCommand(nil, nil, command, err)
+		return newCommand(output{}, output{}, command, err)
 	}
+	addRunning(cmd.Process)
+	defer removeRunning(cmd.Process)
 
-	cmd.Stderr = os.Stderr
+	done := make(chan struct{})
+	var stopped <-chan stopReason
+	if opts.Timeout > 0 || ctx.Done() != nil {
+		stopped = watch(ctx, cmd.Process, opts.Timeout, opts.KillGrace, done)
+	}
 
-	err = cmd.Start()
-	if err != nil {
-		return newCommand(nil, nil, command, err)
+	// stderr must be read concurrently with stdout so that neither pipe fills
+	// and blocks the process.
+	errout := make(chan output, 1)
+	go func() {
+		errout <- bufferOutput(epipe)
+	}()
+	var out output
+	if opts.LineFunc != nil {
+		out = lineOutput(opipe, i, opts.LineFunc)
+	} else {
+		out = bufferOutput(opipe)
 	}
+	if c, ok := opipe.(io.ReadCloser); ok {
+		c.Close()
+	}
+	serr := <-errout
+
+	// Wait must only be called after all reads from the pipes are finished.
+	err = cmd.Wait()
+	close(done)
+	if out.err != nil {
+		err = out.err
+	} else if serr.err != nil {
+		err = serr.err
+	}
+	if err == nil && callback != nil {
+		if e, ok := <-errch; ok {
+			err = e
+		}
+	}
+	var c *Command
+	reason := stopNone
+	if stopped != nil {
+		reason = <-stopped
+	}
+	if reason == stopCancel {
+		c = newCommand(out, serr, command, ctx.Err())
+		c.Killed = true
+	} else {
+		c = newCommand(out, serr, command, err)
+		c.TimedOut = reason == stopTimeout
+	}
+	c.Usage = getUsage(cmd.ProcessState)
+	return c
+}
+
+// stopReason indicates why (if at all) watch signalled a process.
+type stopReason int
+
+const (
+	stopNone stopReason = iota
+	stopTimeout
+	stopCancel
+)
+
+// watch kills the process group of p if ctx is cancelled. If timeout is greater than 0
+// and the process is still running after timeout, the group is sent SIGTERM and then
+// SIGKILL if it has not finished grace later. done must be closed once the process has
+// exited. The returned channel reports whether and why the process was signalled.
+func watch(ctx context.Context, p *os.Process, timeout, grace time.Duration, done <-chan struct{}) <-chan stopReason {
+	if grace <= 0 {
+		grace = DefaultKillGrace
+	}
+	res := make(chan stopReason, 1)
+	go func() {
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-done:
+			res <- stopNone
+			return
+		case <-ctx.Done():
+			signalGroup(p, syscall.SIGKILL)
+			res <- stopCancel
+			return
+		case <-expired:
+		}
+		signalGroup(p, syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-ctx.Done():
+			signalGroup(p, syscall.SIGKILL)
+		case <-time.After(grace):
+			signalGroup(p, syscall.SIGKILL)
+		}
+		res <- stopTimeout
+	}()
+	return res
+}
+
+// output holds the buffered contents of a stream (stdout or stderr) of a process.
+// Up to BufferSize bytes are kept in memory, anything larger is written to a
+// gzipped temporary file.
+type output struct {
+	*bufio.Reader
+	tmp *os.File
+	// number of bytes read.
+	n   int64
+	err error
+}
 
-	bpipe := bufio.NewReaderSize(opipe, BufferSize)
+// bufferOutput reads r until EOF and returns an output that can be used to
+// read it again.
+func bufferOutput(r io.Reader) output {
+	bpipe := bufio.NewReaderSize(r, BufferSize)
 
-	var res []byte
-	res, err = bpipe.Peek(BufferSize)
+	res, err := bpipe.Peek(BufferSize)
 
 	// less than BufferSize bytes in output...
 	if err == bufio.ErrBufferFull || err == io.EOF {
-		err = cmd.Wait()
-		if err == nil && callback != nil {
-			if e, ok := <-errch; ok {
-				err = e
-			}
-		}
-		return newCommand(bufio.NewReader(bytes.NewReader(res)), nil, command, err)
+		return output{Reader: bufio.NewReader(bytes.NewReader(res)), n: int64(len(res))}
 	}
 	if err != nil {
-		return newCommand(nil, nil, command, err)
+		return output{err: err}
 	}
 
 	// more than BufferSize bytes in output. must use tmpfile
-	var tmp *os.File
-	tmp, err = ioutil.TempFile("", prefix)
+	tmp, err := ioutil.TempFile("", prefix)
 	if err != nil {
-		return newCommand(bufio.NewReader(bytes.NewReader(res)), tmp, command, err)
+		return output{Reader: bufio.NewReader(bytes.NewReader(res)), err: err}
 	}
+	o := output{Reader: bufio.NewReader(bytes.NewReader(res)), tmp: tmp}
 
 	gtmp, err := gzip.NewWriterLevel(tmp, gzip.BestSpeed)
 	if err != nil {
-		return newCommand(bufio.NewReader(bytes.NewReader(res)), tmp, command, err)
+		o.err = err
+		return o
 	}
 
-	_, err = io.CopyBuffer(gtmp, bpipe, res)
-	if err != nil {
-		return newCommand(bufio.NewReader(bytes.NewReader(res)), tmp, command, err)
-	}
-	if c, ok := opipe.(io.ReadCloser); ok {
-		c.Close()
+	if o.n, err = io.CopyBuffer(gtmp, bpipe, res); err != nil {
+		o.err = err
+		return o
 	}
 	gtmp.Flush()
 	gtmp.Close()
-	_, err = tmp.Seek(0, 0)
-	if err == nil {
-		err = cmd.Wait()
+	if _, err = tmp.Seek(0, 0); err != nil {
+		o.err = err
+		return o
 	}
-	if err == nil && callback != nil {
-		if e, ok := <-errch; ok {
-			err = e
+	grdr, err := gzip.NewReader(tmp)
+	if err != nil {
+		o.err = err
+		return o
+	}
+	o.Reader = bufio.NewReader(grdr)
+	return o
+}
+
+// lineMu serializes calls to Options.LineFunc.
+var lineMu sync.Mutex
+
+// lineOutput sends each line from r to fn as soon as it is read. The returned output
+// has an empty Reader and n is the number of bytes read.
+func lineOutput(r io.Reader, i int, fn func(i int, line []byte)) output {
+	o := output{Reader: bufio.NewReader(bytes.NewReader(nil))}
+	br := bufio.NewReaderSize(r, 65536)
+	var partial []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		o.n += int64(len(line))
+		if err == bufio.ErrBufferFull {
+			// a very long line. keep it until the rest arrives.
+			partial = append(partial, line...)
+			continue
+		}
+		if len(partial) > 0 {
+			line = append(partial, line...)
+			partial = partial[:0]
+		}
+		if len(line) > 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line[:len(line):len(line)], '\n')
+			}
+			lineMu.Lock()
+			fn(i, line)
+			lineMu.Unlock()
+		}
+		if err != nil {
+			if err != io.EOF {
+				o.err = err
+			}
+			return o
 		}
 	}
-	var grdr *gzip.Reader
-	grdr, err = gzip.NewReader(tmp)
-	return newCommand(bufio.NewReader(grdr), tmp, command, err)
 }
 
 // istring holds a command and an index.
@@ -273,22 +651,50 @@ type istring struct {
 // if istdout is nil, then we only add the index. otherwise, when
 // push a channel onto istdout and into each istring to keep
 // the order.
-func enumerate(commands <-chan string, istdout chan chan *Command) chan istring {
+// enumerate stops reading commands when ctx is done or stop is closed.
+func enumerate(ctx context.Context, stop <-chan struct{}, commands <-chan string, istdout chan chan *Command) chan istring {
 	ch := make(chan istring)
-	var cmdch chan *Command
 	go func() {
-		i := 0
-		for c := range commands {
+		defer close(ch)
+		if istdout != nil {
+			defer close(istdout)
+		}
+		for i := 0; ; i++ {
+			var c string
+			var ok bool
+			select {
+			case c, ok = <-commands:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			}
+			var cmdch chan *Command
 			if istdout != nil {
-				cmdch = make(chan *Command)
-				istdout <- cmdch
+				// buffered so that the worker never blocks even if nothing is receiving.
+				cmdch = make(chan *Command, 1)
+				select {
+				case istdout <- cmdch:
+				case <-ctx.Done():
+					return
+				case <-stop:
+					return
+				}
 			}
-			ch <- istring{c, cmdch, i}
-			i++
-		}
-		close(ch)
-		if istdout != nil {
-			close(istdout)
+			select {
+			case ch <- istring{c, cmdch, i}:
+				continue
+			case <-ctx.Done():
+			case <-stop:
+			}
+			// let oRunner know this command will not be run.
+			if cmdch != nil {
+				close(cmdch)
+			}
+			return
 		}
 	}()
 	return ch
@@ -305,38 +711,188 @@ type Options struct {
 	// Retries indicates the number of times a process will be retried if it has
 	// a non-zero exit code.
 	Retries int
+	// RetryDelay is the time to wait before the first retry. It doubles for each
+	// subsequent retry up to RetryMaxDelay (if set). A random jitter of up to half
+	// the delay is subtracted so that failed commands do not retry in lock-step.
+	RetryDelay    time.Duration
+	RetryMaxDelay time.Duration
+	// RetryOn, if set, limits retries to commands that exit with one of these codes.
+	RetryOn []int
+	// NoRetryOn lists exit codes that are never retried.
+	NoRetryOn []int
+	// Timeout, if greater than 0, is the longest a process may run. After that, its
+	// process group is sent SIGTERM and then, KillGrace later, SIGKILL.
+	Timeout time.Duration
+	// KillGrace is the time to wait after SIGTERM before sending SIGKILL to a process
+	// that has timed out. Defaults to DefaultKillGrace.
+	KillGrace time.Duration
+	// Procs is the number of commands that Runner will run concurrently.
+	// If it is 0, runtime.GOMAXPROCS(0) is used.
+	Procs int
+	// Skip, if set, is called by Runner with the index (PROCESS_I) and string of each
+	// command. If it returns true, the command is not run and a Command with Skipped
+	// set is sent in its place. It may be called from multiple goroutines.
+	Skip func(i int, command string) bool
+	// NoShell runs each command directly instead of with $SHELL -c. The command is split
+	// into arguments with SplitArgs so quoting still applies but pipes, redirects and
+	// variables do not.
+	NoShell bool
+	// Finished, if set, is called by Runner with each command that was run as soon as it
+	// finishes. This can be before the command is sent on the channel when Ordered is set.
+	// It may be called from multiple goroutines.
+	Finished func(c *Command)
+	// LineFunc, if set, is called with each line of stdout as soon as it is read rather
+	// than buffering the output. The Reader of the Command is then empty. i is the index of
+	// the command (as in Command.Index) or -1 if it was not run by Runner. Each line ends
+	// with a newline (one is added to the last line if needed) and must not be retained
+	// after the call. Calls are serialized so that lines from different commands are not
+	// interleaved.
+	LineFunc func(i int, line []byte)
+	// Cache, if set, is used by Runner to replay the output of commands that succeeded
+	// before. It is not used with LineFunc.
+	Cache *Cache
+	// CacheKey returns the key in Cache for a command given its index and string. If it
+	// returns "", the command is not cached. If CacheKey is nil, the key is from the
+	// command string, the shell and (if the command uses $PROCESS_I) the index.
+	CacheKey func(i int, command string) string
+	// Shell is used to run each command as: Shell -c command. If it is empty, DefaultShell() is used.
+	Shell string
+}
+
+func (o *Options) cacheKey(i int, command string) string {
+	if o.CacheKey != nil {
+		return o.CacheKey(i, command)
+	}
+	shell := o.shell()
+	if o.NoShell {
+		shell = ""
+	}
+	parts := [][]byte{[]byte(shell), []byte(command)}
+	// a command that uses $PROCESS_I may give different output for each index.
+	if strings.Contains(command, "PROCESS_I") {
+		parts = append(parts, []byte(fmt.Sprintf("PROCESS_I=%d", i)))
+	}
+	return Key(parts...)
+}
+
+// retry reports whether a command that exited with code should be retried.
+func (o *Options) retry(code int) bool {
+	if code == 0 || hasInt(o.NoRetryOn, code) {
+		return false
+	}
+	return len(o.RetryOn) == 0 || hasInt(o.RetryOn, code)
+}
+
+// retryDelay returns the time to wait before the nth (1-based) retry.
+func (o *Options) retryDelay(n int) time.Duration {
+	d := o.RetryDelay
+	for i := 1; i < n && d > 0 && d < 1<<40; i++ {
+		if o.RetryMaxDelay > 0 && d >= o.RetryMaxDelay {
+			break
+		}
+		d *= 2
+	}
+	if o.RetryMaxDelay > 0 && d > o.RetryMaxDelay {
+		d = o.RetryMaxDelay
+	}
+	if d <= 1 {
+		return d
+	}
+	return d - time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func hasInt(a []int, v int) bool {
+	for _, x := range a {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+func (o *Options) shell() string {
+	if o.Shell == "" {
+		return DefaultShell()
+	}
+	return o.Shell
+}
+
+func (o *Options) procs() int {
+	if o.Procs > 0 {
+		return o.Procs
+	}
+	return runtime.GOMAXPROCS(0)
 }
 
 // Runner accepts commands from a channel and sends a bufio.Reader on the returned channel.
-// done allows the caller to stop Runner, for example if an error occurs.
-// It will parallelize according to GOMAXPROCS. See Options for more details.
+// done allows the caller to stop Runner, for example if an error occurs. Commands that are
+// already running are left to finish but their output is discarded.
+// It will run Options.Procs commands at a time. See Options for more details.
 func Runner(commands <-chan string, cancel <-chan bool, opts *Options) chan *Command {
+	stop := make(chan struct{})
+	// closed by runner when it is finished so that this goroutine exits even if cancel is never closed.
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-cancel:
+			close(stop)
+		case <-finished:
+		}
+	}()
+	return runner(context.Background(), stop, finished, commands, opts)
+}
+
+// RunnerContext is like Runner but it is stopped by cancelling ctx. When that happens,
+// no more commands are read and the process groups of running commands are killed.
+// Every command that was read is sent on the returned channel (those that were killed
+// have Killed set) so the caller must receive until the channel is closed.
+func RunnerContext(ctx context.Context, commands <-chan string, opts *Options) chan *Command {
+	return runner(ctx, nil, nil, commands, opts)
+}
+
+// runner runs commands until they are exhausted, ctx is done, or stop is closed.
+// ctx is used to kill running commands. If stop is closed, results are dropped
+// rather than sent. If finished is not nil, it is closed after the returned channel.
+func runner(ctx context.Context, stop <-chan struct{}, finished chan struct{}, commands <-chan string, opts *Options) chan *Command {
 	if opts.Ordered {
-		return oRunner(commands, cancel, opts)
+		return oRunner(ctx, stop, finished, commands, opts)
 	}
 
-	stdout := make(chan *Command, runtime.GOMAXPROCS(0))
-	icommands := enumerate(commands, nil)
+	procs := opts.procs()
+	stdout := make(chan *Command, procs)
+	icommands := enumerate(ctx, stop, commands, nil)
 
 	wg := &sync.WaitGroup{}
-	wg.Add(runtime.GOMAXPROCS(0))
+	wg.Add(procs)
 
 	// Start a number of workers equal to the requested procs.
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+	for i := 0; i < procs; i++ {
 		go func() {
 			defer wg.Done()
 			// workers read off the same channel of incoming commands.
 			for cmd := range icommands {
+				if stopped(stop) {
+					return
+				}
+				c := runI(ctx, cmd, opts)
 				select {
-				case stdout <- Run(cmd.string, opts, fmt.Sprintf("PROCESS_I=%d", cmd.i)):
-				case <-cancel:
-					// if we receive from this, we must exit.
-					// receive from closed channel will continually yield false
-					// so it does what we expect.
-					close(stdout)
-					break
+				case stdout <- c:
+				case <-stop:
+					// receive from closed channel will continually yield
+					// so each worker exits and the last closes stdout.
+					c.Cleanup()
+					return
 				}
-
 			}
 		}()
 	}
@@ -344,44 +900,77 @@ func Runner(commands <-chan string, cancel <-chan bool, opts *Options) chan *Com
 	go func() {
 		wg.Wait()
 		close(stdout)
+		if finished != nil {
+			close(finished)
+		}
 	}()
 
 	return stdout
 }
 
+// stopped is a non-blocking check of whether stop has been closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
 // use separate runner when they want output in order of input. this
 // uses istdout and a channel of channels where a channel gets pushed oneRun
 // in the order of input and that same channel gets pushed to when they
 // command is finished.
-func oRunner(commands <-chan string, cancel <-chan bool, opts *Options) chan *Command {
+func oRunner(ctx context.Context, stop <-chan struct{}, finished chan struct{}, commands <-chan string, opts *Options) chan *Command {
 
-	stdout := make(chan *Command, runtime.GOMAXPROCS(0))
+	procs := opts.procs()
+	stdout := make(chan *Command, procs)
 
-	// this means that if e.g. 12 processors are available and WaitingMultiplier is 4
+	// this means that if e.g. 12 procs are requested and WaitingMultiplier is 4
 	// then up to 47 finished processes can be blocked waiting for the slowest one to finish.
-	istdout := make(chan chan *Command, WaitingMultiplier*runtime.GOMAXPROCS(0))
-	icommands := enumerate(commands, istdout)
+	istdout := make(chan chan *Command, WaitingMultiplier*procs)
+	icommands := enumerate(ctx, stop, commands, istdout)
 
 	// Start a number of workers equal to the requested procs.
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+	for i := 0; i < procs; i++ {
 		go func() {
 			// workers read off the same channel of incoming commands.
 			for cmd := range icommands {
-				oRun(cmd, opts, fmt.Sprintf("PROCESS_I=%d", cmd.i))
+				if stopped(stop) {
+					return
+				}
+				oRun(ctx, cmd, opts)
 			}
 		}()
 	}
 
 	go func() {
+		defer func() {
+			close(stdout)
+			if finished != nil {
+				close(finished)
+			}
+		}()
 		for ch := range istdout {
+			var c *Command
+			var ok bool
 			select {
-
-			case stdout <- <-ch:
-			case <-cancel:
-				break
+			case c, ok = <-ch:
+				// closed without a value if enumerate stopped before sending the command.
+				if !ok {
+					continue
+				}
+			case <-stop:
+				return
+			}
+			select {
+			case stdout <- c:
+			case <-stop:
+				c.Cleanup()
+				return
 			}
 		}
-		close(stdout)
 	}()
 
 	return stdout
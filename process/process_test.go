@@ -2,13 +2,18 @@ package process_test
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/brentp/gargs/process"
 )
@@ -270,3 +275,477 @@ func TestLongRunnerError(t *testing.T) {
 	}
 
 }
+
+func TestStderr(t *testing.T) {
+	for _, bs := range []int{10, 1048576} {
+		process.BufferSize = bs
+		cmd := process.Run("echo -n out; seq 99 >&2", nil)
+		if cmd.Err != nil {
+			t.Fatal(cmd.Err)
+		}
+		out, err := ioutil.ReadAll(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "out" {
+			t.Fatalf("expected: 'out' on stdout, got: '%s'", out)
+		}
+		serr, err := ioutil.ReadAll(cmd.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Split(strings.TrimSpace(string(serr)), "\n"); len(lines) != 99 || lines[98] != "99" {
+			t.Fatalf("expected 99 lines on stderr with BufferSize %d, got: %d", bs, len(lines))
+		}
+		cmd.Cleanup()
+	}
+}
+
+func TestStderrRetries(t *testing.T) {
+	cmd := process.Run("echo -n err >&2; exit 3", &process.Options{Retries: 2})
+	if cmd.ExitCode() != 3 {
+		t.Fatalf("expected exit-code of 3, got %d", cmd.ExitCode())
+	}
+	serr, err := ioutil.ReadAll(cmd.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(serr) != "errerrerr" {
+		t.Fatalf("expected stderr from each attempt, got: '%s'", serr)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	cmds := []string{"sleep 10", "sleep 10 & wait", "trap '' TERM; sleep 10"}
+	for _, cmdStr := range cmds {
+		opts := &process.Options{Timeout: 200 * time.Millisecond, KillGrace: 200 * time.Millisecond}
+		cmd := process.Run(cmdStr, opts)
+		if !cmd.TimedOut {
+			t.Fatalf("expected %s to time out", cmd)
+		}
+		if cmd.ExitCode() != process.TimeoutExit {
+			t.Fatalf("expected exit-code %d, got %d", process.TimeoutExit, cmd.ExitCode())
+		}
+		if cmd.Duration > 3*time.Second {
+			t.Fatalf("expected %s to be killed", cmd)
+		}
+		if !strings.Contains(cmd.String(), "timed-out") {
+			t.Fatalf("expected timed-out in %s", cmd)
+		}
+	}
+
+	cmd := process.Run("echo -n ok", &process.Options{Timeout: 5 * time.Second})
+	if cmd.TimedOut || cmd.ExitCode() != 0 {
+		t.Fatalf("expected %s to finish without timing out", cmd)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	cmd := process.RunContext(ctx, "sleep 10 & wait", &process.Options{Retries: 2})
+	if !cmd.Killed {
+		t.Fatalf("expected %s to be killed", cmd)
+	}
+	if cmd.Err != context.DeadlineExceeded {
+		t.Fatalf("expected error from context, got: %v", cmd.Err)
+	}
+	if cmd.Duration > 3*time.Second {
+		t.Fatalf("expected %s to be killed quickly", cmd)
+	}
+
+	cmd = process.RunContext(ctx, "echo hi", nil)
+	if cmd.Killed || cmd.Err == nil || cmd.Reader != nil {
+		t.Fatalf("expected %s to not be started with a done context", cmd)
+	}
+}
+
+func TestRunnerContext(t *testing.T) {
+	for _, ordered := range []bool{true, false} {
+		cmds := make(chan string)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			defer close(cmds)
+			for {
+				select {
+				case cmds <- "sleep 10":
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		time.AfterFunc(300*time.Millisecond, cancel)
+		t0 := time.Now()
+		n := 0
+		for c := range process.RunnerContext(ctx, cmds, &process.Options{Ordered: ordered}) {
+			if c.ExitCode() == 0 {
+				t.Fatalf("expected %s to fail", c)
+			}
+			n++
+		}
+		if time.Since(t0) > 3*time.Second {
+			t.Fatalf("expected RunnerContext to stop quickly, took %s", time.Since(t0))
+		}
+		if n == 0 {
+			t.Fatalf("expected killed commands to be sent")
+		}
+	}
+}
+
+func TestProcs(t *testing.T) {
+	// Procs must be independent of GOMAXPROCS.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	for _, ordered := range []bool{true, false} {
+		cmds := make(chan string)
+		N := 8
+		go func() {
+			for i := 0; i < N; i++ {
+				cmds <- "sleep 0.5"
+			}
+			close(cmds)
+		}()
+		done := make(chan bool)
+		t0 := time.Now()
+		for c := range process.Runner(cmds, done, &process.Options{Procs: N, Ordered: ordered}) {
+			if c.ExitCode() != 0 {
+				t.Fatalf("unexpected error: %s", c)
+			}
+		}
+		close(done)
+		if d := time.Since(t0); d > 2*time.Second {
+			t.Fatalf("expected %d commands to run concurrently, took %s", N, d)
+		}
+	}
+}
+
+func TestRunnerNoLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for _, ordered := range []bool{true, false} {
+		cmds := make(chan string, 2)
+		cmds <- "true"
+		cmds <- "true"
+		close(cmds)
+		// cancel is never closed.
+		for range process.Runner(cmds, nil, &process.Options{Procs: 2, Ordered: ordered}) {
+		}
+	}
+	// the workers may still be exiting.
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("expected no goroutines left after Runner, got %d more", n-before)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	for _, ordered := range []bool{true, false} {
+		cmds := make(chan string)
+		go func() {
+			for i := 0; i < 10; i++ {
+				cmds <- "echo -n $PROCESS_I"
+			}
+			close(cmds)
+		}()
+		done := make(chan bool)
+		opts := &process.Options{Ordered: ordered, Skip: func(i int, cmd string) bool { return i%2 == 0 }}
+		n := 0
+		for c := range process.Runner(cmds, done, opts) {
+			if c.Skipped {
+				n++
+				continue
+			}
+			out, err := ioutil.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// PROCESS_I is not changed by skipping.
+			if i, _ := strconv.Atoi(string(out)); i%2 != 1 {
+				t.Fatalf("expected only odd PROCESS_I to run, got %s", out)
+			}
+		}
+		close(done)
+		if n != 5 {
+			t.Fatalf("expected 5 skipped commands, got %d", n)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	process.BufferSize = 1048576
+	cmd := process.Run("echo -n abc; echo -n de >&2; kill -9 $$", &process.Options{Retries: 1})
+	if cmd.Signal() != syscall.SIGKILL {
+		t.Fatalf("expected SIGKILL, got %d", cmd.Signal())
+	}
+	if cmd.ExitCode() != 128+9 {
+		t.Fatalf("expected exit-code 137, got %d", cmd.ExitCode())
+	}
+	if cmd.Retries != 1 {
+		t.Fatalf("expected 1 retry, got %d", cmd.Retries)
+	}
+	if cmd.StdoutBytes != 3 || cmd.StderrBytes != 4 {
+		t.Fatalf("expected 3 bytes of stdout and 4 of stderr (from 2 attempts), got %d, %d", cmd.StdoutBytes, cmd.StderrBytes)
+	}
+	if cmd.Spilled() || cmd.SpilledBytes() != 0 {
+		t.Fatal("expected output in memory")
+	}
+	if cmd.Start.IsZero() || time.Since(cmd.Start) < cmd.Duration {
+		t.Fatalf("bad start time: %s", cmd.Start)
+	}
+
+	process.BufferSize = 10
+	defer func() { process.BufferSize = 1048576 }()
+	cmd = process.Run("seq 100", nil)
+	if !cmd.Spilled() || cmd.StdoutBytes != 292 {
+		t.Fatalf("expected spilled output of 292 bytes, got %d", cmd.StdoutBytes)
+	}
+	if cmd.SpilledBytes() != 292 {
+		t.Fatalf("expected 292 spilled bytes, got %d", cmd.SpilledBytes())
+	}
+	cmd.Cleanup()
+}
+
+func TestUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("usage is only available on linux")
+	}
+	cmd := process.Run("i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done; exit 1", &process.Options{Retries: 1})
+	if cmd.Usage == nil {
+		t.Fatalf("expected usage for %s", cmd)
+	}
+	if cmd.Usage.User+cmd.Usage.System == 0 || cmd.Usage.MaxRSS == 0 {
+		t.Fatalf("expected non-zero usage, got: %s", cmd.Usage)
+	}
+	if !strings.Contains(cmd.String(), "max-rss") {
+		t.Fatalf("expected usage in %s", cmd)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		out []string
+	}{
+		{"echo a  b", []string{"echo", "a", "b"}},
+		{`echo 'a b' "c \"d\" \x" e\ f`, []string{"echo", "a b", `c "d" \x`, "e f"}},
+		{`printf '%s\n' 'it'\''s'`, []string{"printf", `%s\n`, "it's"}},
+		{"echo '' x", []string{"echo", "", "x"}},
+	} {
+		args, err := process.SplitArgs(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%q", args) != fmt.Sprintf("%q", c.out) {
+			t.Errorf("%s: expected %q, got %q", c.in, c.out, args)
+		}
+	}
+	if _, err := process.SplitArgs("echo 'a"); err == nil {
+		t.Error("expected an error for an unterminated quote")
+	}
+}
+
+func TestNoShell(t *testing.T) {
+	opts := &process.Options{NoShell: true}
+	cmd := process.Run(`printf '%s|' 'a b' $HOME "c;d"`, opts)
+	if cmd.Err != nil {
+		t.Fatal(cmd.Err)
+	}
+	out, _ := ioutil.ReadAll(cmd)
+	if string(out) != "a b|$HOME|c;d|" {
+		t.Fatalf("expected arguments to be passed as-is, got: %q", out)
+	}
+	cmd = process.Run("gargs-no-such-command", opts)
+	if cmd.Err == nil || cmd.ExitCode() == 0 {
+		t.Fatalf("expected an error for a missing command, got: %s", cmd)
+	}
+}
+
+func TestShell(t *testing.T) {
+	if err := process.CheckShell("sh"); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.CheckShell("gargs-no-such-shell"); err == nil {
+		t.Fatal("expected an error for a missing shell")
+	}
+	if err := process.CheckShell("false"); err == nil {
+		t.Fatal("expected an error for a shell that fails")
+	}
+	cmd := process.Run("echo $0", &process.Options{Shell: "sh"})
+	out, _ := ioutil.ReadAll(cmd)
+	if strings.TrimSpace(string(out)) != "sh" {
+		t.Fatalf("expected command to run with sh, got: %q", out)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	opts := &process.Options{Retries: 2, RetryDelay: 40 * time.Millisecond}
+	cmd := process.Run("exit 3", opts)
+	if len(cmd.Attempts) != 3 || cmd.Retries != 2 {
+		t.Fatalf("expected 3 attempts, got: %d", len(cmd.Attempts))
+	}
+	for _, a := range cmd.Attempts {
+		if a.ExitCode != 3 || a.Start.IsZero() {
+			t.Fatalf("unexpected attempt: %+v", a)
+		}
+	}
+	// the delays are 40ms then 80ms less up to half of each.
+	if cmd.Duration < 60*time.Millisecond {
+		t.Fatalf("expected retries to be delayed, took: %s", cmd.Duration)
+	}
+	if gap := cmd.Attempts[2].Start.Sub(cmd.Attempts[1].Start); gap < 40*time.Millisecond {
+		t.Fatalf("expected delay to increase, got: %s", gap)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	cmd = process.RunContext(ctx, "exit 3", &process.Options{Retries: 2, RetryDelay: time.Hour})
+	if time.Since(t0) > 5*time.Second || len(cmd.Attempts) != 1 {
+		t.Fatalf("expected cancel to stop waiting for a retry. attempts: %d", len(cmd.Attempts))
+	}
+}
+
+func TestRetryOn(t *testing.T) {
+	for _, c := range []struct {
+		opts     process.Options
+		attempts int
+	}{
+		{process.Options{Retries: 2, RetryOn: []int{2}}, 3},
+		{process.Options{Retries: 2, RetryOn: []int{1, 75}}, 1},
+		{process.Options{Retries: 2, NoRetryOn: []int{2}}, 1},
+		{process.Options{Retries: 2, NoRetryOn: []int{1}}, 3},
+	} {
+		cmd := process.Run("exit 2", &c.opts)
+		if len(cmd.Attempts) != c.attempts || cmd.Retries != c.attempts-1 {
+			t.Errorf("%+v: expected %d attempts, got %d", c.opts, c.attempts, len(cmd.Attempts))
+		}
+	}
+}
+
+func TestFinished(t *testing.T) {
+	ch := make(chan string)
+	go func() {
+		ch <- "sleep 1"
+		ch <- "exit 2"
+		close(ch)
+	}()
+	finished := make(chan *process.Command, 2)
+	opts := &process.Options{Ordered: true, Procs: 2, Finished: func(c *process.Command) { finished <- c }}
+	t0 := time.Now()
+	out := process.Runner(ch, nil, opts)
+	// the failed command is reported by Finished before the slower one that precedes it in the output.
+	if c := <-finished; c.ExitCode() != 2 || time.Since(t0) > 900*time.Millisecond {
+		t.Fatalf("expected the failed command to finish first, got: %s", c)
+	}
+	for range out {
+	}
+}
+
+func TestLineFunc(t *testing.T) {
+	ch := make(chan string)
+	go func() {
+		ch <- "echo a; sleep 0.5; printf b"
+		ch <- "sleep 0.2; echo c"
+		close(ch)
+	}()
+	var lines []string
+	opts := &process.Options{Procs: 2, LineFunc: func(i int, line []byte) {
+		lines = append(lines, fmt.Sprintf("%d:%s", i, line))
+	}}
+	for c := range process.Runner(ch, nil, opts) {
+		if c.Err != nil {
+			t.Fatal(c.Err)
+		}
+		if out, _ := ioutil.ReadAll(c); len(out) != 0 {
+			t.Fatalf("expected empty output with LineFunc, got: %q", out)
+		}
+	}
+	// lines are seen as they are written rather than when each command finishes.
+	if strings.Join(lines, "") != "0:a\n1:c\n0:b\n" {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gargs-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := process.NewCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(cmds ...string) []*process.Command {
+		ch := make(chan string)
+		go func() {
+			for _, c := range cmds {
+				ch <- c
+			}
+			close(ch)
+		}()
+		var res []*process.Command
+		for c := range process.Runner(ch, nil, &process.Options{Ordered: true, Cache: cache}) {
+			res = append(res, c)
+		}
+		return res
+	}
+	cmd := "echo $RANDOM$RANDOM; echo err >&2"
+	first := run(cmd, "echo x; exit 2")
+	out, _ := ioutil.ReadAll(first[0])
+	if first[0].Cached || len(out) == 0 {
+		t.Fatalf("expected command to run: %s", first[0])
+	}
+	second := run(cmd, "echo x; exit 2")
+	if !second[0].Cached || second[1].Cached {
+		t.Fatalf("expected only the successful command to be cached: %s %s", second[0], second[1])
+	}
+	out2, _ := ioutil.ReadAll(second[0])
+	serr, _ := ioutil.ReadAll(second[0].Stderr)
+	if string(out2) != string(out) || string(serr) != "err\n" {
+		t.Fatalf("expected cached output %q, got %q (stderr: %q)", out, out2, serr)
+	}
+
+	if second[0].Start.IsZero() || len(second[0].Attempts) != 1 {
+		t.Fatalf("expected a start time and one attempt for a cached command: %s", second[0])
+	}
+
+	// output larger than BufferSize is spilled to a temp file before and after it is cached.
+	defer func(n int) { process.BufferSize = n }(process.BufferSize)
+	process.BufferSize = 100
+	for i := 0; i < 2; i++ {
+		big := run("seq 1 200")[0]
+		if big.Cached != (i == 1) {
+			t.Fatalf("expected Cached to be %v: %s", i == 1, big)
+		}
+		out, _ := ioutil.ReadAll(big)
+		if n := len(strings.Split(strings.TrimSpace(string(out)), "\n")); n != 200 {
+			t.Fatalf("expected 200 lines of output, got %d", n)
+		}
+		big.Cleanup()
+	}
+
+	// $PROCESS_I is part of the key only for commands that use it.
+	res := run("echo $PROCESS_I", "echo $PROCESS_I")
+	out3, _ := ioutil.ReadAll(res[1])
+	if res[1].Cached || string(out3) != "1\n" {
+		t.Fatalf("expected a different key for each PROCESS_I, got %q from %s", out3, res[1])
+	}
+	if res = run("echo moved", "echo a"); res[0].Cached {
+		t.Fatalf("expected the first run to not be cached: %s", res[0])
+	}
+	if res = run("echo a", "echo moved"); !res[1].Cached {
+		t.Fatalf("expected a command at a different index to be cached: %s", res[1])
+	}
+
+	// a small MaxSize evicts the least recently used entries.
+	small, err := process.NewCache(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache = small
+	run("echo a", "echo b")
+	if entries, _ := ioutil.ReadDir(dir); len(entries) > 1 {
+		t.Fatalf("expected entries to be evicted, got %d", len(entries))
+	}
+}
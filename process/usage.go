@@ -0,0 +1,35 @@
+package process
+
+import (
+	"fmt"
+	"time"
+)
+
+// Usage holds the resources used by a command and its children.
+type Usage struct {
+	// User and System are the CPU time spent in user and system mode.
+	User   time.Duration
+	System time.Duration
+	// MaxRSS is the maximum resident set size in kilobytes.
+	MaxRSS int64
+	// VoluntaryCtxSw and InvoluntaryCtxSw are the number of context switches.
+	VoluntaryCtxSw   int64
+	InvoluntaryCtxSw int64
+}
+
+// String returns a short summary of the usage.
+func (u *Usage) String() string {
+	return fmt.Sprintf("user: %s, sys: %s, max-rss: %dKB, ctx-switches: %d",
+		u.User, u.System, u.MaxRSS, u.VoluntaryCtxSw+u.InvoluntaryCtxSw)
+}
+
+// Add accumulates o into u. CPU time and context switches are summed and MaxRSS is the max.
+func (u *Usage) Add(o *Usage) {
+	u.User += o.User
+	u.System += o.System
+	if o.MaxRSS > u.MaxRSS {
+		u.MaxRSS = o.MaxRSS
+	}
+	u.VoluntaryCtxSw += o.VoluntaryCtxSw
+	u.InvoluntaryCtxSw += o.InvoluntaryCtxSw
+}
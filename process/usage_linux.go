@@ -0,0 +1,26 @@
+// +build linux
+
+package process
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func getUsage(ps *os.ProcessState) *Usage {
+	if ps == nil {
+		return nil
+	}
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return nil
+	}
+	return &Usage{
+		User:             time.Duration(ru.Utime.Nano()),
+		System:           time.Duration(ru.Stime.Nano()),
+		MaxRSS:           ru.Maxrss,
+		VoluntaryCtxSw:   ru.Nvcsw,
+		InvoluntaryCtxSw: ru.Nivcsw,
+	}
+}
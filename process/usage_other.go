@@ -0,0 +1,10 @@
+// +build !linux
+
+package process
+
+import "os"
+
+// getUsage is only implemented for linux where the units of rusage are known.
+func getUsage(ps *os.ProcessState) *Usage {
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/brentp/gargs/process"
+)
+
+// progress shows a status line on stderr with the number of commands that have finished,
+// the rate and an estimate of the time remaining. Other output must be written through
+// writer() so that the line is cleared first.
+type progress struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+	// total is the number of commands (from --total) or 0 if it is not known.
+	total int
+	procs int
+	// sent returns the number of commands that have been sent to the runner.
+	sent func() int
+
+	done, failed int
+	// avg is a moving average of the run-time of each command.
+	avg time.Duration
+	// shown is true when the status line is on the screen.
+	shown bool
+	stop  chan struct{}
+}
+
+// ewmaWeight is the weight of the newest duration in the moving average.
+const ewmaWeight = 0.1
+
+func newProgress(w io.Writer, total, procs int, sent func() int) *progress {
+	p := &progress{w: w, start: time.Now(), total: total, procs: procs, sent: sent, stop: make(chan struct{})}
+	go func() {
+		t := time.NewTicker(200 * time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.mu.Lock()
+				p.draw()
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// add counts a finished command. It is called from process.Options.Finished so it may be called concurrently.
+func (p *progress) add(c *process.Command) {
+	if errors.Is(c.Err, context.Canceled) && !c.Killed {
+		// not started because gargs is stopping.
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if c.ExitCode() != 0 {
+		p.failed++
+	}
+	if c.Cached {
+		return
+	}
+	if p.avg == 0 {
+		p.avg = c.Duration
+	} else {
+		p.avg += time.Duration(ewmaWeight * float64(c.Duration-p.avg))
+	}
+}
+
+// skip counts a command that was not run because it was not needed (e.g. with --resume).
+func (p *progress) skip() {
+	p.mu.Lock()
+	p.done++
+	p.mu.Unlock()
+}
+
+// status returns the text of the status line.
+func (p *progress) status() string {
+	elapsed := time.Since(p.start)
+	running := p.sent() - p.done
+	if running > p.procs {
+		running = p.procs
+	}
+	if running < 0 {
+		running = 0
+	}
+	s := fmt.Sprintf("gargs: %d", p.done)
+	if p.total > 0 {
+		s += fmt.Sprintf("/%d", p.total)
+	}
+	s += fmt.Sprintf(" done, %d failed, %d running", p.failed, running)
+	if secs := elapsed.Seconds(); secs > 0 {
+		s += fmt.Sprintf(", %.1f jobs/s", float64(p.done)/secs)
+	}
+	if left := p.total - p.done; p.total > 0 && left > 0 && p.avg > 0 {
+		par := p.procs
+		if left < par {
+			par = left
+		}
+		eta := time.Duration(float64(p.avg) * float64(left) / float64(par))
+		s += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	return s
+}
+
+// draw writes the status line. p.mu must be held.
+func (p *progress) draw() {
+	fmt.Fprintf(p.w, "\r\x1b[K%s", p.status())
+	p.shown = true
+}
+
+// clear removes the status line. p.mu must be held.
+func (p *progress) clear() {
+	if p.shown {
+		io.WriteString(p.w, "\r\x1b[K")
+		p.shown = false
+	}
+}
+
+// Close stops updating and leaves the final status on its own line.
+func (p *progress) Close() {
+	close(p.stop)
+	p.mu.Lock()
+	p.draw()
+	io.WriteString(p.w, "\n")
+	p.shown = false
+	p.mu.Unlock()
+}
+
+// writer returns a writer to w that clears the status line before each write.
+func (p *progress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &progressWriter{p: p, w: w}
+}
+
+type progressWriter struct {
+	p *progress
+	w io.Writer
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	pw.p.mu.Lock()
+	defer pw.p.mu.Unlock()
+	pw.p.clear()
+	return pw.w.Write(b)
+}
+
+// showProgress decides whether to show the progress line from the flags and whether stderr is a terminal.
+func showProgress(args *Params, stderrTTY bool) bool {
+	if args.DryRun || args.NoProgress {
+		return false
+	}
+	return args.Progress || stderrTTY
+}
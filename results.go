@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/brentp/gargs/process"
+)
+
+// checkResultsKey returns an error if key can not be used as the name of a directory in --results.
+func checkResultsKey(key string) error {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, "/\\\x00") || strings.HasPrefix(key, ".tmp-") {
+		return fmt.Errorf("invalid name for --results directory: %q", key)
+	}
+	return nil
+}
+
+// writeResults writes the stdout, stderr, exit code and command of c to files in dir/key.
+// They are written to a temporary directory that is then renamed so that dir/key is either
+// complete or absent. An existing dir/key (e.g. from an earlier run) is replaced.
+func writeResults(dir, key string, c *process.Command) error {
+	tmp, err := ioutil.TempDir(dir, ".tmp-"+key+"-")
+	if err != nil {
+		return err
+	}
+	// TempDir is only readable by the user.
+	if err = os.Chmod(tmp, 0755); err == nil {
+		err = writeResultFiles(tmp, c)
+	}
+	if err == nil {
+		final := filepath.Join(dir, key)
+		if err = os.RemoveAll(final); err == nil {
+			err = os.Rename(tmp, final)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+	}
+	return err
+}
+
+func writeResultFiles(dir string, c *process.Command) error {
+	if err := copyFile(filepath.Join(dir, "stdout"), c.Reader); err != nil {
+		return err
+	}
+	if err := copyFile(filepath.Join(dir, "stderr"), c.Stderr); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "exitcode"), []byte(fmt.Sprintf("%d\n", c.ExitCode())), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "cmd"), []byte(c.CmdStr+"\n"), 0644)
+}
+
+// copyFile writes the contents of r (which may be nil) to a new file at path.
+func copyFile(path string, r *bufio.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		_, err = io.Copy(f, r)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// logSuffix matches the end of the last line of each command written to the --log:
+// the run-time and any extra fields (e.g. timeout).
+var logSuffix = regexp.MustCompile(" #\t[0-9]+s(\t[^\t]*)*$")
+
+// logFooter matches the line written to the --log after all commands have finished.
+var logFooter = regexp.MustCompile("^# (SUCCESS|FAILED [0-9]+ commands)$")
+
+// readSucceeded reads a file written by --log and returns the set of commands that
+// finished successfully. These are the ones prefixed with '#'.
+func readSucceeded(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	succeeded := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 16384), 5e9)
+	// lines of a multi-line command. each is prefixed with '# ' if the command succeeded.
+	var lines []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "# ") || logFooter.MatchString(line) {
+			lines = lines[:0]
+			continue
+		}
+		line = line[2:]
+		if loc := logSuffix.FindStringIndex(line); loc != nil {
+			lines = append(lines, line[:loc[0]])
+			succeeded[strings.Join(lines, "\n")] = true
+			lines = lines[:0]
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	return succeeded, scanner.Err()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brentp/gargs/process"
+)
+
+// nSlowest is the number of slowest commands that are named in the --summary.
+const nSlowest = 3
+
+// summary accumulates the commands from run for the report given by --summary.
+type summary struct {
+	Total      int `json:"total"`
+	Succeeded  int `json:"succeeded"`
+	Failed     int `json:"failed"`
+	Retried    int `json:"retried"`
+	Skipped    int `json:"skipped"`
+	NotStarted int `json:"not_started"`
+	Cached     int `json:"cached"`
+	// WallTime is the time from the start of run and JobTime is the sum of the durations
+	// of the commands. Parallelism is their ratio.
+	WallTime    float64 `json:"wall_time"`
+	JobTime     float64 `json:"job_time"`
+	Parallelism float64 `json:"parallelism"`
+	P50         float64 `json:"p50"`
+	P90         float64 `json:"p90"`
+	Max         float64 `json:"max"`
+	Slowest     []slow  `json:"slowest"`
+	// SpilledBytes is the output that was too large for memory and was written to temp files.
+	SpilledBytes int64 `json:"spilled_bytes"`
+	// resource usage of all commands. these are 0 if it is not available.
+	UserTime float64 `json:"user_time"`
+	SysTime  float64 `json:"sys_time"`
+	MaxRSS   int64   `json:"max_rss_kb"`
+
+	start     time.Time
+	durations []time.Duration
+	usage     process.Usage
+	nusage    int
+}
+
+// slow is one of the slowest commands.
+type slow struct {
+	Cmd      string  `json:"cmd"`
+	Duration float64 `json:"duration"`
+}
+
+func newSummary() *summary {
+	return &summary{start: time.Now(), Slowest: []slow{}}
+}
+
+// add counts a command that was run. It must be called before the command is cleaned up.
+func (s *summary) add(p *process.Command) {
+	s.Total++
+	if p.ExitCode() == 0 {
+		s.Succeeded++
+	} else {
+		s.Failed++
+	}
+	if p.Retries > 0 {
+		s.Retried++
+	}
+	if p.Cached {
+		s.Cached++
+	}
+	s.SpilledBytes += p.SpilledBytes()
+	if p.Usage != nil {
+		s.usage.Add(p.Usage)
+		s.nusage++
+	}
+	s.durations = append(s.durations, p.Duration)
+	// keep only the slowest so that the commands themselves are not all held in memory.
+	d := p.Duration.Seconds()
+	i := sort.Search(len(s.Slowest), func(i int) bool { return s.Slowest[i].Duration < d })
+	if i < nSlowest {
+		s.Slowest = append(s.Slowest, slow{})
+		copy(s.Slowest[i+1:], s.Slowest[i:])
+		s.Slowest[i] = slow{Cmd: p.CmdStr, Duration: d}
+		if len(s.Slowest) > nSlowest {
+			s.Slowest = s.Slowest[:nSlowest]
+		}
+	}
+}
+
+// skip counts a command that was not run because it was not needed (e.g. with --resume).
+func (s *summary) skip() {
+	s.Total++
+	s.Skipped++
+}
+
+// notStarted counts a command that was not started because of --halt.
+func (s *summary) notStarted() {
+	s.Total++
+	s.NotStarted++
+}
+
+// finish sets the fields that are calculated from all of the commands.
+func (s *summary) finish() {
+	s.WallTime = time.Since(s.start).Seconds()
+	var sum time.Duration
+	for _, d := range s.durations {
+		sum += d
+	}
+	s.JobTime = sum.Seconds()
+	if s.WallTime > 0 {
+		s.Parallelism = s.JobTime / s.WallTime
+	}
+	sort.Slice(s.durations, func(i, j int) bool { return s.durations[i] < s.durations[j] })
+	s.P50 = percentile(s.durations, 50).Seconds()
+	s.P90 = percentile(s.durations, 90).Seconds()
+	s.Max = percentile(s.durations, 100).Seconds()
+	s.UserTime = s.usage.User.Seconds()
+	s.SysTime = s.usage.System.Seconds()
+	s.MaxRSS = s.usage.MaxRSS
+}
+
+// percentile returns the nearest-rank percentile of sorted durations.
+func percentile(sorted []time.Duration, pct int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (pct*len(sorted)+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// write reports the summary to w as text or as a single line of JSON.
+func (s *summary) write(w io.Writer, format string) error {
+	s.finish()
+	if format == "json" {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+	sec := func(f float64) time.Duration {
+		return time.Duration(f * float64(time.Second)).Round(time.Millisecond)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "gargs: %d commands: %d succeeded, %d failed, %d retried, %d skipped, %d not started, %d cached\n",
+		s.Total, s.Succeeded, s.Failed, s.Retried, s.Skipped, s.NotStarted, s.Cached)
+	fmt.Fprintf(&b, "gargs: wall time: %s, command time: %s, parallelism: %.2f\n", sec(s.WallTime), sec(s.JobTime), s.Parallelism)
+	if len(s.durations) > 0 {
+		fmt.Fprintf(&b, "gargs: durations: p50: %s, p90: %s, max: %s\n", sec(s.P50), sec(s.P90), sec(s.Max))
+		for _, c := range s.Slowest {
+			fmt.Fprintf(&b, "gargs: slowest: %s\t%s\n", sec(c.Duration), strings.Replace(c.Cmd, "\n", "\\n", -1))
+		}
+	}
+	fmt.Fprintf(&b, "gargs: spilled to temp files: %d bytes\n", s.SpilledBytes)
+	if s.nusage > 0 {
+		fmt.Fprintf(&b, "gargs: resources used by %d commands: %s\n", s.nusage, &s.usage)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
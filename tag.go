@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// prefixWriter writes prefix at the start of each line written to w.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	// mid is true when the last write did not end with a newline.
+	mid bool
+}
+
+// tagWriter returns w or, with --tag, a writer that prefixes each line with the tag of j.
+func tagWriter(w io.Writer, j *job) io.Writer {
+	if j == nil || j.tag == "" {
+		return w
+	}
+	return &prefixWriter{w: w, prefix: []byte(j.tag)}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if !p.mid {
+			if _, err := p.w.Write(p.prefix); err != nil {
+				return n, err
+			}
+		}
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i != -1 {
+			line = b[:i+1]
+		}
+		m, err := p.w.Write(line)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p.mid = line[len(line)-1] != '\n'
+		b = b[len(line):]
+	}
+	return n, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/brentp/gargs/process"
+	"github.com/valyala/fasttemplate"
+)
+
+// commandTmpl fills the command template with the values for each job.
+type commandTmpl struct {
+	tmpl *fasttemplate.Template
+	// with --no-shell, the template is split into arguments once and each is filled separately.
+	argv []*fasttemplate.Template
+	// strict makes a place-holder without a value an error.
+	strict bool
+	quote  bool
+	buf    bytes.Buffer
+}
+
+func newCommandTmpl(args *Params) (*commandTmpl, error) {
+	cmd := strings.Replace(args.Command, "{}", "{Line}", -1)
+	t := &commandTmpl{strict: args.JSONL, quote: args.Quote}
+	if !args.NoShell {
+		t.tmpl = fasttemplate.New(cmd, "{", "}")
+		return t, nil
+	}
+	words, err := process.SplitArgs(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	for _, w := range words {
+		t.argv = append(t.argv, fasttemplate.New(w, "{", "}"))
+	}
+	return t, nil
+}
+
+// newTmpl returns a template for one of the other options (e.g. --tag-template or --creates)
+// where, as in the command, {} is the whole line.
+func newTmpl(s string) *fasttemplate.Template {
+	return fasttemplate.New(strings.Replace(s, "{}", "{Line}", -1), "{", "}")
+}
+
+// fill writes the command for the place-holder values in m to w. With --no-shell, each
+// argument is quoted so that the command can be shown (and logged) as it would be run by
+// a shell. process.SplitArgs then recovers the arguments.
+func (t *commandTmpl) fill(w io.Writer, m map[string]interface{}) error {
+	if t.tmpl != nil {
+		return fillTmpl(w, t.tmpl, m, t.strict, t.quote)
+	}
+	for i, a := range t.argv {
+		t.buf.Reset()
+		if err := fillTmpl(&t.buf, a, m, t.strict, false); err != nil {
+			return err
+		}
+		if i > 0 {
+			io.WriteString(w, " ")
+		}
+		io.WriteString(w, shellQuote(t.buf.String()))
+	}
+	return nil
+}
+
+// missingError is returned by fillTmpl for a place-holder with no value.
+type missingError struct {
+	tag string
+}
+
+func (e *missingError) Error() string {
+	return fmt.Sprintf("no value for place-holder {%s}", e.tag)
+}
+
+// rawPrefix marks a place-holder that is not quoted with --quote, e.g. {raw:0}.
+const rawPrefix = "raw:"
+
+// fillTmpl writes tmpl to w with the place-holders replaced by their values in m.
+// If strict is true, a place-holder without a value is an error. Otherwise it is left empty.
+// If quote is true, values are quoted for the shell unless the place-holder starts with "raw:".
+func fillTmpl(w io.Writer, tmpl *fasttemplate.Template, m map[string]interface{}, strict, quote bool) error {
+	_, err := tmpl.ExecuteFunc(w, func(w io.Writer, tag string) (int, error) {
+		raw := strings.HasPrefix(tag, rawPrefix)
+		v, err := lookup(m, strings.TrimPrefix(tag, rawPrefix))
+		if err != nil && strict {
+			return 0, err
+		}
+		if quote && !raw {
+			v = shellQuote(v)
+		}
+		return io.WriteString(w, v)
+	})
+	return err
+}
+
+// shellQuote returns s quoted so that a POSIX shell will read it as a single word.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, unsafeShell) == -1 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// unsafeShell reports whether r may need to be quoted in a shell word.
+func unsafeShell(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("@%+=:,./_-", r)
+}
+
+// modifiers that can follow a place-holder. Longer ones must come first.
+var modifiers = []struct {
+	suffix string
+	fn     func(string) string
+}{
+	{"/.", func(p string) string { return stripExt(filepath.Base(p)) }},
+	{"//", filepath.Dir},
+	{"/", filepath.Base},
+	{".", stripExt},
+}
+
+// stripExt removes the extension from the last element of p.
+func stripExt(p string) string {
+	return strings.TrimSuffix(p, filepath.Ext(p))
+}
+
+// lookup finds the value of tag in m. If tag is not in m, it may be a place-holder followed by a modifier:
+// '/' for the basename, '//' for the dirname, '.' to remove the extension, '/.' for the basename without
+// the extension or '%' and a suffix to remove, e.g. {0%.fastq.gz}.
+// Without a place-holder (e.g. {/.}) the modifier is applied to the entire line.
+func lookup(m map[string]interface{}, tag string) (string, error) {
+	if v, ok := m[tag]; ok {
+		return v.(string), nil
+	}
+	if i := strings.Index(tag, "%"); i != -1 {
+		v, err := lookup(m, lineTag(tag[:i]))
+		return strings.TrimSuffix(v, tag[i+1:]), err
+	}
+	for _, mod := range modifiers {
+		if strings.HasSuffix(tag, mod.suffix) {
+			name := lineTag(strings.TrimSuffix(tag, mod.suffix))
+			if v, ok := m[name]; ok {
+				return mod.fn(v.(string)), nil
+			}
+			return "", &missingError{name}
+		}
+	}
+	return "", &missingError{tag}
+}
+
+// lineTag returns the tag for the entire line if tag is empty.
+func lineTag(tag string) string {
+	if tag == "" {
+		return "Line"
+	}
+	return tag
+}
@@ -109,7 +109,7 @@ assert_exit_code 0
 
 # different code-path that uses tmpfiles if we have > 4MB of data for each
 fn_test_big() {
-	seq 10 | SHELL=python go run main.go  "for i in range(100): print ''.join('{}' for i in xrange(90000))"
+	seq 10 | SHELL=python ./gargs_race "for i in range(100): print ''.join('{}' for i in xrange(90000))"
 }
 run check_big fn_test_big
 assert_exit_code 0
@@ -133,6 +133,19 @@ run check_retries fn_check_retries
 assert_exit_code 1
 assert_equal $(grep -c ZeroDivisionError $STDERR_FILE) "4"
 
+fn_check_retry_on() {
+	printf '2\n3\n' | ./gargs_race --retry 2 --retry-delay 10ms --retry-on 2,75 --log __r.log 'echo {} >&2; exit {}'
+	ret=$?
+	cat __r.log
+	return $ret
+}
+run check_retry_on fn_check_retry_on
+assert_exit_code 3
+assert_equal $(grep -c '^2$' $STDERR_FILE) "3"
+assert_equal $(grep -c '^3$' $STDERR_FILE) "1"
+assert_in_stdout "tries=3"
+rm -f __r.log
+
 fn_check_nlines2() {
 	seq 1 10 | ./gargs_race -n 5  "echo {} blah"
 }
@@ -151,3 +164,280 @@ assert_exit_code 0
 assert_equal $(cat $STDOUT_FILE | wc -l) 4
 assert_in_stdout "7 8 9"
 assert_equal $(grep -c "^10$" $STDOUT_FILE) 1
+
+fn_check_stderr() {
+	seq 1 8 | ./gargs_race $ORDERED -p 8 'for i in $(seq 200); do echo -n {} >&2; done; echo >&2'
+}
+run check_stderr fn_check_stderr
+assert_exit_code 0
+assert_equal 8 $(grep -cE "^(1+|2+|3+|4+|5+|6+|7+|8+)$" $STDERR_FILE)
+
+fn_check_timeout() {
+	echo -e "0.1\n10" | ./gargs_race $ORDERED -p 2 --timeout 1s --kill-grace 1s -l __t.log 'sleep {}; echo {}'
+}
+run check_timeout fn_check_timeout
+assert_exit_code 124
+assert_in_stdout "0.1"
+assert_in_stderr "TIMEOUT with command"
+assert_equal 1 $(grep -c "timeout$" __t.log)
+rm -f __t.log
+
+fn_check_resume() {
+	rm -f __r.log __ran __flag
+	seq 1 4 | ./gargs_race $ORDERED -p 2 -l __r.log 'echo {} >> __ran; test {} -ne 3 || test -e __flag'
+	touch __flag
+	seq 1 4 | ./gargs_race $ORDERED -p 2 --resume __r.log 'echo {} >> __ran; test {} -ne 3 || test -e __flag'
+}
+run check_resume fn_check_resume
+assert_exit_code 0
+assert_equal 5 $(cat __ran | wc -l)
+assert_equal 2 $(grep -c "^3$" __ran)
+assert_equal 1 $(grep -c "^# FAILED 1 commands" __r.log)
+assert_equal "# SUCCESS" "$(tail -1 __r.log)"
+rm -f __r.log __ran __flag
+
+fn_check_resume_new_log() {
+	rm -f __r.log __r2.log
+	seq 1 3 | ./gargs_race $ORDERED -l __r.log 'test {} -ne 3'
+	seq 1 3 | ./gargs_race $ORDERED --resume __r.log -l __r2.log 'test {} -ne 3'
+	cp __r2.log __r2.orig
+	seq 1 3 | ./gargs_race $ORDERED --resume __r2.log -d 'test {} -ne 3'
+}
+run check_resume_new_log fn_check_resume_new_log
+assert_exit_code 0
+assert_equal "test 3 -ne 3" "$(cat $STDOUT_FILE)"
+assert_equal 2 $(grep -c "skipped$" __r2.log)
+# a dry-run does not write to the --resume log.
+assert_equal 0 $(cmp -s __r2.log __r2.orig; echo $?)
+rm -f __r.log __r2.log __r2.orig
+
+fn_check_stop_on_error() {
+	seq 1 6 | ./gargs_race $ORDERED -e -p 2 -l __e.log 'if [ {} -eq 2 ]; then exit 3; fi; sleep 10'
+}
+run check_stop_on_error fn_check_stop_on_error
+assert_exit_code 3
+assert_in_stderr "KILLED with command"
+assert_in_stderr "were not started"
+assert_equal 1 $(grep -c "sleep 10 #.*killed$" <(grep "if \[ 1 " __e.log))
+assert_equal 0 $(grep -c "^# if" __e.log)
+rm -f __e.log
+
+fn_check_halt_soon() {
+	seq 1 6 | ./gargs_race $ORDERED -p 1 --halt soon,fail=2 -l __h.log 'test {} -gt 2'
+}
+run check_halt_soon fn_check_halt_soon
+assert_exit_code 1
+assert_in_stderr "halted (--halt soon,fail=2)"
+assert_equal 2 $(grep -c "test [12] -gt 2 #" __h.log)
+assert_equal 0 $(grep -c "^# test" __h.log)
+rm -f __h.log
+
+fn_check_halt_done() {
+	printf '10\n0\n10\n' | ./gargs_race $ORDERED -p 3 --halt now,done=1 'sleep {}; echo {}'
+}
+run check_halt_done fn_check_halt_done
+assert_exit_code 0
+assert_equal "0" "$(cat $STDOUT_FILE)"
+assert_in_stderr "2 running commands were killed"
+
+fn_check_line_buffer() {
+	printf '1\n5\n' | ./gargs_race -p 2 --line-buffer 'echo start {}; sleep 0.{}; printf "end {}"'
+}
+run check_line_buffer fn_check_line_buffer
+assert_exit_code 0
+assert_equal "start 1 start 5 end 1 end 5" "$( (head -2 $STDOUT_FILE | sort; tail -2 $STDOUT_FILE) | tr '\n' ' ' | sed 's/ $//')"
+
+fn_check_tag() {
+	printf 'a 1\nb 2\n' | ./gargs_race $ORDERED -p 2 --tag 'echo x; echo y >&2'
+	printf 'a 1\n' | ./gargs_race --tag-template '{PROCESS_I}:{1}\t' 'echo x'
+	printf 'a 1\n' | ./gargs_race --line-buffer --tag-template '[{0}] ' 'echo x; echo y'
+}
+run check_tag fn_check_tag
+assert_exit_code 0
+assert_in_stdout "a 1	x"
+assert_in_stdout "b 2	x"
+assert_in_stderr "a 1	y"
+assert_in_stdout "0:1	x"
+assert_in_stdout "[a] y"
+
+fn_check_results() {
+	rm -rf __res
+	printf 's1 a\ns2 b\n' | ./gargs_race $ORDERED -p 2 --results __res --results-key '{0}' 'echo out {1}; echo err {1} >&2; test {1} != b'
+}
+run check_results fn_check_results
+assert_exit_code 1
+assert_equal "out a" "$(cat __res/s1/stdout)"
+assert_equal "err b" "$(cat __res/s2/stderr)"
+assert_equal "0" "$(cat __res/s1/exitcode)"
+assert_equal "1" "$(cat __res/s2/exitcode)"
+assert_equal "echo out b; echo err b >&2; test b != b" "$(cat __res/s2/cmd)"
+assert_equal 0 $(grep -c "out a" $STDOUT_FILE)
+assert_equal 0 $(ls -a __res | grep -c tmp)
+rm -rf __res
+
+fn_check_creates() {
+	rm -rf __mk && mkdir __mk && touch __mk/a.in __mk/b.in __mk/c.in
+	printf 'a\nb\nc\n' | ./gargs_race $ORDERED -p 2 --creates '__mk/{}.out' --depends '__mk/{}.in' 'echo {} > __mk/{}.out; test {} != c'
+	printf 'a\nb\nc\n' | ./gargs_race $ORDERED -l __mk/run.log --creates '__mk/{}.out' --depends '__mk/{}.in' 'echo {} > __mk/{}.out'
+}
+run check_creates fn_check_creates
+assert_exit_code 0
+assert_equal 2 $(grep -c "skipped$" __mk/run.log)
+assert_equal 1 $(grep -c "^# echo c > __mk/c.out #" __mk/run.log)
+assert_equal "# SUCCESS" "$(tail -1 __mk/run.log)"
+rm -rf __mk
+
+fn_check_creates_keep() {
+	rm -rf __mk && mkdir __mk && touch __mk/old.out
+	echo x | ./gargs_race --creates __mk --creates __mk/old.out --creates __mk/new.out 'touch __mk/new.out; exit 1'
+}
+run check_creates_keep fn_check_creates_keep
+assert_exit_code 1
+assert_equal 1 $(ls __mk | grep -c old.out)
+assert_equal 0 $(ls __mk | grep -c new.out)
+rm -rf __mk
+
+fn_check_cache() {
+	rm -rf __cache
+	printf 'a\nb\n' | ./gargs_race $ORDERED --cache __cache 'echo {} $RANDOM$RANDOM; test {} = a'
+	printf 'a\nb\n' | ./gargs_race $ORDERED --cache __cache -l __cache.log 'echo {} $RANDOM$RANDOM; test {} = a'
+}
+run check_cache fn_check_cache
+assert_exit_code 1
+assert_equal 1 $(grep "^a " $STDOUT_FILE | sort -u | wc -l)
+assert_equal 2 $(grep -c "^b " $STDOUT_FILE)
+assert_equal 1 $(grep -c "cached$" __cache.log)
+rm -rf __cache __cache.log
+
+fn_check_progress() {
+	seq 1 3 | ./gargs_race $ORDERED --progress --total 3 'echo {}'
+}
+run check_progress fn_check_progress
+assert_exit_code 0
+assert_equal 3 $(cat $STDOUT_FILE | wc -l)
+assert_in_stderr "gargs: 3/3 done, 0 failed"
+
+fn_check_summary() {
+	seq 1 3 | ./gargs_race $ORDERED --summary text 'echo {}; test {} != 2'
+	seq 1 3 | ./gargs_race $ORDERED --summary json 'echo {}' 2> __summary.json
+}
+run check_summary fn_check_summary
+assert_exit_code 0
+assert_in_stderr "gargs: 3 commands: 2 succeeded, 1 failed, 0 retried, 0 skipped, 0 not started"
+assert_in_stderr "gargs: durations: p50:"
+assert_equal 3 $(python -c "import json; print(json.load(open('__summary.json'))['succeeded'])")
+rm -f __summary.json
+
+fn_check_joblog() {
+	printf "a\tb\n1 2\n" | ./gargs_race $ORDERED -p 2 --joblog __j.tsv -s "\s+" 'echo {0}{1}; test {0} != 1'
+	seq 1 3 | ./gargs_race $ORDERED -n 2 --joblog __j.json --joblog-format jsonl 'echo {}'
+}
+run check_joblog fn_check_joblog
+assert_exit_code 0
+assert_equal 3 $(cat __j.tsv | wc -l)
+assert_equal "PROCESS_I	input	start	wall_time	exit_code	signal	retries	stdout_bytes	stderr_bytes	spilled	user_time	sys_time	max_rss_kb	ctx_switches" "$(head -1 __j.tsv)"
+assert_equal "0 0 3 false" "$(awk -F'\t' '$2 == "a\\tb" { print $5, $7, $8, $10 }' __j.tsv)"
+assert_equal "1 0 3 false" "$(awk -F'\t' '$2 == "1 2" { print $5, $7, $8, $10 }' __j.tsv)"
+assert_equal 2 $(cat __j.json | wc -l)
+assert_equal 1 $(grep -c '"input":\["1","2"\]' __j.json)
+rm -f __j.tsv __j.json
+
+if [[ "$(uname)" == "Linux" ]]; then
+fn_check_usage() {
+	seq 1 3 | ./gargs_race $ORDERED -v -l __u.log 'echo {}'
+}
+run check_usage fn_check_usage
+assert_exit_code 0
+assert_equal 3 $(grep -c "maxrss=[0-9]*KB" __u.log)
+assert_in_stderr "resources used by 3 commands"
+rm -f __u.log
+fi
+
+fn_check_null() {
+	printf 'a b\0c\nd\0' | ./gargs_race $ORDERED -0 -n 2 'echo "[{1}]"'
+	printf 'e f;g h' | ./gargs_race $ORDERED --record-sep ';' 'echo "[{1}]"'
+}
+run check_null fn_check_null
+assert_exit_code 0
+assert_in_stdout "[c"
+assert_in_stdout "d]"
+assert_in_stdout "[f]"
+assert_in_stdout "[h]"
+assert_equal 4 $(cat $STDOUT_FILE | wc -l)
+
+fn_check_nlines_sep() {
+	printf 'r1 a_1.fq a_2.fq\nr2 b_1.fq b_2.fq\nr3 c_1.fq c_2.fq\n' | ./gargs_race --dry-run -n 2 -s '\s+' 'align {0.1} {1.2} > {0.0}.bam # {0}'
+}
+run check_nlines_sep fn_check_nlines_sep
+assert_exit_code 0
+assert_equal 2 $(cat $STDOUT_FILE | wc -l)
+assert_in_stdout "align a_1.fq b_2.fq > r1.bam # r1 a_1.fq a_2.fq"
+assert_in_stdout "align c_1.fq  > r3.bam # r3 c_1.fq c_2.fq"
+
+fn_check_header() {
+	printf 'sample bam\ns1 a.bam\n' | ./gargs_race --dry-run --header 'echo {sample} {bam} {1}'
+	printf 'sample,bam\n"s 2","b,c.bam"\n' | ./gargs_race --dry-run --csv --header 'echo "{sample}" "{bam}"'
+	printf 'sample\tbam\ns3\td.bam\ns4\te.bam\n' | ./gargs_race --dry-run --csv --sep '\t' --header -n 2 'echo {0.sample} {1.bam}'
+}
+run check_header fn_check_header
+assert_exit_code 0
+assert_equal 3 $(cat $STDOUT_FILE | wc -l)
+assert_in_stdout "echo s1 a.bam a.bam"
+assert_in_stdout 'echo "s 2" "b,c.bam"'
+assert_in_stdout "echo s3 e.bam"
+
+fn_check_jsonl() {
+	printf '{"sample": "s 1", "files": ["a.fq", "b.fq"], "meta": {"read_group": "rg1", "n": 3}}\n' | ./gargs_race --dry-run --jsonl 'echo "{sample}" {files.0} {files.1} {meta.read_group} {meta.n}'
+	printf '{"a": 1}\n{"a": 2}\n' | ./gargs_race --dry-run --jsonl -n 2 'echo {0.a} {1.a}'
+}
+run check_jsonl fn_check_jsonl
+assert_exit_code 0
+assert_equal 2 $(cat $STDOUT_FILE | wc -l)
+assert_in_stdout 'echo "s 1" a.fq b.fq rg1 3'
+assert_in_stdout "echo 1 2"
+
+run check_jsonl_missing ./gargs_race --dry-run --jsonl 'echo {sample}' <<< $'{"sample": "s1"}\n{"name": "s2"}'
+assert_exit_code 1
+assert_in_stderr "input line 2: no value for place-holder {sample}"
+
+fn_check_modifiers() {
+	echo "/data/s1.fastq.gz x/s2.bam" | ./gargs_race --dry-run 'echo {0/} {0//} {0.} {0/.} {1/.} {0%.fastq.gz} {0/%.fastq.gz}'
+	printf 'bam\nx/y.bam\n' | ./gargs_race --dry-run --header 'echo {bam/.}'
+	echo "a/b.txt" | ./gargs_race --dry-run 'echo {/} {//} {.} {/.}'
+}
+run check_modifiers fn_check_modifiers
+assert_exit_code 0
+assert_in_stdout "echo s1.fastq.gz /data /data/s1.fastq s1.fastq s2 /data/s1 s1"
+assert_in_stdout "echo y"
+assert_in_stdout "echo b.txt a a/b b"
+
+fn_check_quote() {
+	printf '%s\n' "a  b" "it's" '$HOME;x' | ./gargs_race -o --quote 'echo {}'
+	echo '$HOME x' | ./gargs_race --dry-run --quote 'echo {0} {1} {raw:0}'
+}
+run check_quote fn_check_quote
+assert_exit_code 0
+assert_in_stdout "a  b"
+assert_in_stdout "it's"
+assert_in_stdout '$HOME;x'
+assert_in_stdout "echo '\$HOME' x \$HOME"
+
+fn_check_no_shell() {
+	printf '%s\n' "a  b" "it's" '$HOME;x' | ./gargs_race -o --no-shell "printf '<%s>\n' {}"
+	echo "a b" | ./gargs_race --dry-run --no-shell "printf '%s\n' {} 'c d'"
+}
+run check_no_shell fn_check_no_shell
+assert_exit_code 0
+assert_in_stdout "<a  b>"
+assert_in_stdout "<it's>"
+assert_in_stdout '<$HOME;x>'
+assert_in_stdout "printf '%s\n' 'a b' 'c d'"
+
+run check_shell ./gargs_race -v --shell sh 'echo $0' <<< "a"
+assert_exit_code 0
+assert_in_stdout "sh"
+assert_in_stderr "using shell: sh"
+
+run check_bad_shell ./gargs_race --shell gargs-no-such-shell 'echo {}' <<< "a"
+assert_exit_code 255
+assert_in_stderr "unable to use shell"